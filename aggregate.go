@@ -0,0 +1,248 @@
+package unbolted
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+/*
+Group is the aggregate of the results of a query sharing the same value in a field.
+Sums contains the sums of the fields given to GroupBy.
+*/
+type Group struct {
+	Value interface{}
+	Count int
+	Sums  map[string]float64
+}
+
+/*
+numeric returns value, or the value it points to, as a float64, or false if it is a nil pointer.
+*/
+func numeric(value reflect.Value) (result float64, found bool, err error) {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		result = float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		result = float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		result = value.Float()
+	default:
+		err = fmt.Errorf("%v is not a numeric type", value.Type())
+		return
+	}
+	found = true
+	return
+}
+
+/*
+aggregate runs f with the fields of each result of this query, as objects of the same type as obj.
+*/
+func (self *Query) aggregate(obj interface{}, fields []string, f func(fields []reflect.Value) error) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	for _, field := range fields {
+		if _, _, err = resolveField(self.typ, field); err != nil {
+			return
+		}
+	}
+	return self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+			// The order doesn't change the aggregates, unless it decides which results are limited away or we are continuing after a token.
+			unordered: self.limit == 0 && self.after == "",
+			fields:    fields,
+		}
+		return run.each(func(elementPointer reflect.Value) (cont bool, err error) {
+			values := make([]reflect.Value, len(fields))
+			for index, field := range fields {
+				if values[index], err = fieldByName(elementPointer.Elem(), field); err != nil {
+					return
+				}
+			}
+			if err = f(values); err != nil {
+				return
+			}
+			cont = true
+			return
+		})
+	})
+}
+
+/*
+Sum returns the sum of the numeric field of the objects of the same type as obj matching this query.
+Nil pointers are ignored.
+*/
+func (self *Query) Sum(obj interface{}, field string) (result float64, err error) {
+	err = self.aggregate(obj, []string{field}, func(values []reflect.Value) (err error) {
+		f, _, err := numeric(values[0])
+		result += f
+		return
+	})
+	return
+}
+
+/*
+Avg returns the average of the numeric field of the objects of the same type as obj matching this query, or false if there were none.
+Nil pointers are ignored.
+*/
+func (self *Query) Avg(obj interface{}, field string) (result float64, found bool, err error) {
+	count := 0
+	if err = self.aggregate(obj, []string{field}, func(values []reflect.Value) (err error) {
+		f, ok, err := numeric(values[0])
+		if ok {
+			result += f
+			count++
+		}
+		return
+	}); err != nil {
+		return
+	}
+	if count > 0 {
+		result /= float64(count)
+		found = true
+	}
+	return
+}
+
+/*
+extreme returns the field value of the objects matching this query that sorts first in the given direction.
+If the field is indexed and the query is not limited or ordered otherwise, the index is used to find it without loading any other objects.
+*/
+func (self *Query) extreme(obj interface{}, field string, direction Direction) (result interface{}, found bool, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	typ := value.Type()
+	f, _, err := resolveField(typ, field)
+	if err != nil {
+		return
+	}
+	if multiValued(f.Type) || mapped(f.Type) {
+		err = fmt.Errorf("%v.%v is multi valued, and has no single minimum or maximum", typ.Name(), field)
+		return
+	}
+	if indexed(typ, field) && f.Type.Kind() != reflect.Ptr && len(self.orders) == 0 && self.limit == 0 && self.after == "" && !self.rank {
+		ordered := *self
+		ordered.orders = []order{{
+			field:     field,
+			direction: direction,
+		}}
+		ordered.limit = 1
+		first := reflect.New(typ)
+		if found, err = ordered.First(first.Interface()); err != nil || !found {
+			return
+		}
+		var fieldValue reflect.Value
+		if fieldValue, err = fieldByName(first.Elem(), field); err != nil {
+			return
+		}
+		result = fieldValue.Interface()
+		return
+	}
+	var best []byte
+	err = self.aggregate(obj, []string{field}, func(values []reflect.Value) (err error) {
+		if values[0].Kind() == reflect.Ptr && values[0].IsNil() {
+			return
+		}
+		var b []byte
+		// Compare the indexed values, so that the order is the same as when the index is used.
+		if b, err = indexBytes(values[0].Type(), indexValue(f, values[0])); err != nil {
+			return
+		}
+		if cmp := bytes.Compare(b, best); !found || (direction == Asc && cmp < 0) || (direction == Desc && cmp > 0) {
+			best = b
+			result = values[0].Interface()
+			found = true
+		}
+		return
+	})
+	return
+}
+
+/*
+Min returns the smallest value of field in the objects of the same type as obj matching this query, or false if there were none.
+Nil pointers are ignored.
+*/
+func (self *Query) Min(obj interface{}, field string) (result interface{}, found bool, err error) {
+	return self.extreme(obj, field, Asc)
+}
+
+/*
+Max returns the largest value of field in the objects of the same type as obj matching this query, or false if there were none.
+Nil pointers are ignored.
+*/
+func (self *Query) Max(obj interface{}, field string) (result interface{}, found bool, err error) {
+	return self.extreme(obj, field, Desc)
+}
+
+type groupsByValue struct {
+	groups []Group
+	keys   []string
+}
+
+func (self groupsByValue) Len() int {
+	return len(self.groups)
+}
+
+func (self groupsByValue) Swap(i, j int) {
+	self.groups[i], self.groups[j] = self.groups[j], self.groups[i]
+	self.keys[i], self.keys[j] = self.keys[j], self.keys[i]
+}
+
+func (self groupsByValue) Less(i, j int) bool {
+	return self.keys[i] < self.keys[j]
+}
+
+/*
+GroupBy returns the number of objects of the same type as obj matching this query for each value of field, and the sums of the numeric fields in sums, ordered by value.
+*/
+func (self *Query) GroupBy(obj interface{}, field string, sums ...string) (result []Group, err error) {
+	byKey := map[string]int{}
+	var keys []string
+	if err = self.aggregate(obj, append([]string{field}, sums...), func(values []reflect.Value) (err error) {
+		var b []byte
+		if b, err = indexBytes(values[0].Type(), values[0]); err != nil {
+			return
+		}
+		index, found := byKey[string(b)]
+		if !found {
+			index = len(result)
+			byKey[string(b)] = index
+			keys = append(keys, string(b))
+			result = append(result, Group{
+				Value: values[0].Interface(),
+				Sums:  map[string]float64{},
+			})
+		}
+		group := &result[index]
+		group.Count++
+		for i, sum := range sums {
+			var f float64
+			if f, _, err = numeric(values[i+1]); err != nil {
+				return
+			}
+			group.Sums[sum] += f
+		}
+		return
+	}); err != nil {
+		return
+	}
+	sort.Sort(groupsByValue{
+		groups: result,
+		keys:   keys,
+	})
+	return
+}
@@ -0,0 +1,95 @@
+package unbolted
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+/*
+ids returns the Ids of the results of this query, at most Limit of them, in the order of the query.
+The Ids are copied, so that the results can be changed or deleted after.
+*/
+func (self *queryRun) ids() (result [][]byte, err error) {
+	err = self.eachKV(func(kv kv) (cont bool, err error) {
+		result = append(result, append([]byte{}, kv.Keys[0]...))
+		cont = self.query.limit < 1 || len(result) < self.query.limit
+		return
+	})
+	return
+}
+
+/*
+Delete will delete the objects of the same type as obj matching this query in a read/write transaction, and return how many were deleted.
+Each object is deleted like TX.Del does it, with the same events and Deleted calls.
+*/
+func (self *Query) Delete(obj interface{}) (result int, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	err = self.update(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+		}
+		var ids [][]byte
+		if ids, err = run.ids(); err != nil {
+			return
+		}
+		for _, id := range ids {
+			deleted := reflect.New(self.typ)
+			deleted.Elem().FieldByName(idField).SetBytes(id)
+			if err = tx.Del(deleted.Interface()); err != nil {
+				return
+			}
+			result++
+		}
+		return
+	})
+	return
+}
+
+/*
+Update will run f with each object of the same type as obj matching this query, as a pointer to a new value of that type, and save it in a read/write transaction.
+It returns how many objects were updated.
+Each object is saved like TX.Set does it, with the same events and Updated calls, so f must not change the Id.
+The whole objects are loaded, even if fields are selected.
+*/
+func (self *Query) Update(obj interface{}, f func(obj interface{}) error) (result int, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	err = self.update(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+		}
+		var ids [][]byte
+		if ids, err = run.ids(); err != nil {
+			return
+		}
+		for _, id := range ids {
+			updated := reflect.New(self.typ)
+			if err = tx.get(id, updated.Elem(), updated.Interface()); err != nil {
+				return
+			}
+			if err = f(updated.Interface()); err != nil {
+				return
+			}
+			if !bytes.Equal(updated.Elem().FieldByName(idField).Bytes(), id) {
+				err = fmt.Errorf("updating %v %v changed its Id", self.typ.Name(), Id(id))
+				return
+			}
+			if err = tx.Set(updated.Interface()); err != nil {
+				return
+			}
+			result++
+		}
+		return
+	})
+	return
+}
@@ -0,0 +1,180 @@
+package unbolted
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/zond/setop"
+)
+
+var cardinalityKey = []byte("card")
+
+/*
+unknownCardinality is the cardinality of sources that aren't counted, which makes them sort after all counted ones.
+*/
+const unknownCardinality = math.MaxInt32
+
+/*
+count adds delta to the number of keys in bucket, which is found by digging through keys.
+The counts are kept in a separate bucket, keyed by the source key of the bucket they count.
+Buckets without a count are new, since DB.Reindex counts all buckets when indexes are rebuilt from an older format.
+They are counted only if they have at most one key, since counting more keys would read them all, and are otherwise left without a count.
+*/
+func (self *TX) count(keys [][]byte, bucket *bolt.Bucket, delta int) (err error) {
+	self.planned = nil
+	counts, err := self.tx.CreateBucketIfNotExists(cardinalityKey)
+	if err != nil {
+		return
+	}
+	key := joinKeys(keys)
+	n := 0
+	if b := counts.Get(key); b != nil {
+		n = int(binary.BigEndian.Uint64(b)) + delta
+	} else {
+		cursor := bucket.Cursor()
+		if first, _ := cursor.First(); first != nil {
+			if second, _ := cursor.Next(); second != nil {
+				return
+			}
+			n = 1
+		}
+	}
+	// Empty buckets keep a count of zero, so that they are known to be empty.
+	if n < 0 {
+		n = 0
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return counts.Put(key, b)
+}
+
+/*
+cardinalities caches the cardinalities of the sources of the plan being made, so that sources nested in several set operations are only estimated once.
+*/
+type cardinalities struct {
+	keys map[string]int
+	ops  map[*setop.SetOp]int
+}
+
+/*
+cardinality returns an estimate of the number of results of source, which is exact for index value buckets and narrow spans of them, and an upper bound for set operations.
+The estimates are cached until the plan is done or the counts change.
+*/
+func (self *TX) cardinality(source setop.SetOpSource) (result int) {
+	if self.planned == nil {
+		self.planned = &cardinalities{
+			keys: map[string]int{},
+			ops:  map[*setop.SetOp]int{},
+		}
+	}
+	found := false
+	if source.SetOp != nil {
+		if result, found = self.planned.ops[source.SetOp]; !found {
+			result = self.opCardinality(source.SetOp)
+			self.planned.ops[source.SetOp] = result
+		}
+		return
+	}
+	if result, found = self.planned.keys[string(source.Key)]; !found {
+		result = self.keyCardinality(source.Key)
+		self.planned.keys[string(source.Key)] = result
+	}
+	return
+}
+
+/*
+opCardinality returns an upper bound of the number of results of op.
+*/
+func (self *TX) opCardinality(op *setop.SetOp) (result int) {
+	switch op.Type {
+	case setop.Union:
+		for _, child := range op.Sources {
+			if result += self.cardinality(child); result >= unknownCardinality {
+				return unknownCardinality
+			}
+		}
+		return
+	case setop.Intersection:
+		result = unknownCardinality
+		for _, child := range op.Sources {
+			result = minimum(result, self.cardinality(child))
+		}
+		return
+	case setop.Difference:
+		return self.cardinality(op.Sources[0])
+	}
+	return unknownCardinality
+}
+
+/*
+keyCardinality returns the number of results of the source with key, if it is an index value bucket or a span of them.
+*/
+func (self *TX) keyCardinality(key []byte) int {
+	if bytes.Equal(key, emptySource.Key) {
+		return 0
+	}
+	if span, ok := parseSpan(key); ok {
+		return span.cardinality(self)
+	}
+	keys := splitKeys(key)
+	if len(keys) == 0 || !bytes.Equal(keys[0], secondaryIndex) {
+		return unknownCardinality
+	}
+	if _, err := self.dig(keys, false); err != nil {
+		if err == ErrNotFound {
+			return 0
+		}
+		return unknownCardinality
+	}
+	return self.bucketCardinality(key)
+}
+
+/*
+bucketCardinality returns the count kept for the bucket with the source key, or unknownCardinality if it has none.
+*/
+func (self *TX) bucketCardinality(key []byte) int {
+	if counts := self.tx.Bucket(cardinalityKey); counts != nil {
+		if b := counts.Get(key); b != nil {
+			return int(binary.BigEndian.Uint64(b))
+		}
+	}
+	return unknownCardinality
+}
+
+type sourcesByCardinality struct {
+	sources       []setop.SetOpSource
+	cardinalities []int
+}
+
+func (self sourcesByCardinality) Len() int {
+	return len(self.sources)
+}
+
+func (self sourcesByCardinality) Swap(i, j int) {
+	self.sources[i], self.sources[j] = self.sources[j], self.sources[i]
+	self.cardinalities[i], self.cardinalities[j] = self.cardinalities[j], self.cardinalities[i]
+}
+
+func (self sourcesByCardinality) Less(i, j int) bool {
+	return self.cardinalities[i] < self.cardinalities[j]
+}
+
+/*
+orderSources sorts sources to be intersected by cardinality, smallest first, and returns whether any of them is empty, which makes the intersection empty.
+*/
+func (self *TX) orderSources(sources []setop.SetOpSource) (empty bool) {
+	sorted := sourcesByCardinality{
+		sources:       sources,
+		cardinalities: make([]int, len(sources)),
+	}
+	for index, source := range sources {
+		if sorted.cardinalities[index] = self.cardinality(source); sorted.cardinalities[index] == 0 {
+			empty = true
+		}
+	}
+	sort.Stable(sorted)
+	return
+}
@@ -0,0 +1,281 @@
+package unbolted
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"github.com/zond/setop"
+)
+
+const compositePrefix = "index:"
+
+/*
+compositeIndex is an index over several fields, declared by annotating each of them with the same `unbolted:"index:name"`.
+Its entries are keyed by the values of all the fields, in the order the fields are declared.
+*/
+type compositeIndex struct {
+	fields []pathField
+}
+
+var compositeIndexesCache typeCache
+
+/*
+compositeIndexes returns the composite indexes declared in typ, in the order their first fields are declared.
+*/
+func compositeIndexes(typ reflect.Type) []*compositeIndex {
+	return compositeIndexesCache.get(typ, func() interface{} {
+		var result []*compositeIndex
+		byName := map[string]*compositeIndex{}
+		walkFields(typ, func(field pathField) {
+			for _, param := range strings.Split(field.field.Tag.Get(unbolted), ",") {
+				if strings.HasPrefix(param, compositePrefix) {
+					name := param[len(compositePrefix):]
+					composite, found := byName[name]
+					if !found {
+						composite = &compositeIndex{}
+						byName[name] = composite
+						result = append(result, composite)
+					}
+					composite.fields = append(composite.fields, field)
+				}
+			}
+		})
+		return result
+	}).([]*compositeIndex)
+}
+
+/*
+bucket returns the name of the bucket containing the index, which can't collide with field names since it contains commas.
+*/
+func (self *compositeIndex) bucket() []byte {
+	names := make([]string, len(self.fields))
+	for index, field := range self.fields {
+		names[index] = field.path
+	}
+	return []byte(strings.Join(names, ","))
+}
+
+func (self *compositeIndex) key(id []byte, value reflect.Value, typ reflect.Type) (keys [][]byte, err error) {
+	var tuple []byte
+	for _, field := range self.fields {
+		var b []byte
+		if b, err = indexBytes(field.field.Type, indexValue(field.field, fieldValue(value, field.path, field.field.Type))); err != nil {
+			return
+		}
+		tuple = append(tuple, tupleBytes(b)...)
+	}
+	keys = [][]byte{
+		secondaryIndex,
+		[]byte(typ.Name()),
+		self.bucket(),
+		tuple,
+		id,
+	}
+	return
+}
+
+/*
+tupleBytes encodes b so that concatenated encodings sort like their parts, and the encoding of a prefix of the parts is a prefix of the encoding of all of them.
+*/
+func tupleBytes(b []byte) (result []byte) {
+	for _, c := range b {
+		if c == 0 {
+			result = append(result, 0, 0xff)
+		} else {
+			result = append(result, c)
+		}
+	}
+	return append(result, 0, 1)
+}
+
+/*
+tuplePart decodes the first part of b encoded with tupleBytes.
+*/
+func tuplePart(b []byte) (part, rest []byte) {
+	for index := 0; index < len(b); index++ {
+		if b[index] == 0 && index+1 < len(b) {
+			if b[index+1] == 1 {
+				return part, b[index+2:]
+			}
+			part = append(part, 0)
+			index++
+		} else {
+			part = append(part, b[index])
+		}
+	}
+	return
+}
+
+/*
+coverage returns the encoded values of the leading fields of the index that filters have Equals for, and which filters they were.
+*/
+func (self *compositeIndex) coverage(typ reflect.Type, filters []QFilter) (prefix []byte, covered map[int]bool, err error) {
+	covered = map[int]bool{}
+	for _, field := range self.fields {
+		found := false
+		for index, filter := range filters {
+			if equals, ok := filter.(Equals); ok && !covered[index] && canonicalField(typ, equals.Field) == field.path {
+				var b []byte
+				if b, err = valueBytes(typ, equals.Field, equals.Value); err != nil {
+					return
+				}
+				prefix = append(prefix, tupleBytes(b)...)
+				covered[index] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return
+}
+
+/*
+compositeSource returns a source for the filters covered by the composite index covering most of filters, and the filters it doesn't cover.
+A composite index is used if filters have Equals for all its fields, Equals for some leading fields and a range filter for the next one,
+or Equals for some leading fields that don't have indexes of their own.
+*/
+func compositeSource(tx *TX, typ reflect.Type, filters []QFilter) (result setop.SetOpSource, rest []QFilter, found bool, err error) {
+	var bestCovered map[int]bool
+	for _, composite := range compositeIndexes(typ) {
+		var prefix []byte
+		var covered map[int]bool
+		if prefix, covered, err = composite.coverage(typ, filters); err != nil {
+			return
+		}
+		if len(covered) == 0 || len(covered) < len(bestCovered) {
+			continue
+		}
+		if len(covered) == len(composite.fields) {
+			if len(covered) > len(bestCovered) {
+				result = setop.SetOpSource{
+					Key: joinKeys([][]byte{secondaryIndex, []byte(typ.Name()), composite.bucket(), prefix}),
+				}
+				bestCovered, found = covered, true
+			}
+			continue
+		}
+		// Without a range filter on the next field, the prefix is only worth scanning if some covered field has no index of its own.
+		useful := false
+		for index := range covered {
+			if !indexed(typ, filters[index].(Equals).Field) {
+				useful = true
+			}
+		}
+		r := valueRange{}
+		trailing := composite.fields[len(covered)]
+		for index, filter := range filters {
+			if ranger, ok := filter.(rangeFilter); ok && !covered[index] && canonicalField(typ, ranger.rangeField()) == trailing.path {
+				if r, err = ranger.valueRange(typ); err != nil {
+					return
+				}
+				covered[index] = true
+				useful = true
+				break
+			}
+		}
+		if useful && len(covered) > len(bestCovered) {
+			result = composite.rangeSource(typ, prefix, r)
+			bestCovered, found = covered, true
+		}
+	}
+	for index, filter := range filters {
+		if !bestCovered[index] {
+			rest = append(rest, filter)
+		}
+	}
+	return
+}
+
+func (self *compositeIndex) rangeSource(typ reflect.Type, prefix []byte, r valueRange) setop.SetOpSource {
+	return tupleRangeSource(typ, self.bucket(), prefix, r)
+}
+
+/*
+tupleRangeSource returns a span of all value buckets in the index bucket that start with prefix, where the tuple part following the prefix is within r.
+*/
+func tupleRangeSource(typ reflect.Type, bucket []byte, prefix []byte, r valueRange) setop.SetOpSource {
+	return valueSpan{
+		bucket: [][]byte{secondaryIndex, []byte(typ.Name()), bucket},
+		prefix: prefix,
+		tuple:  true,
+		r:      r,
+	}.source()
+}
+
+/*
+walker returns a groupWalker walking the index buckets starting with prefix, grouped by the part following the prefix.
+*/
+func (self *compositeIndex) walker(tx *TX, typ reflect.Type, prefix []byte, direction Direction) groupWalker {
+	return func(after []byte, f func(value []byte, source setop.SetOpSource) (bool, error)) (err error) {
+		buckets, err := tx.dig([][]byte{secondaryIndex, []byte(typ.Name()), self.bucket()}, false)
+		if err != nil {
+			if err == ErrNotFound {
+				err = nil
+			}
+			return
+		}
+		cursor := buckets[len(buckets)-1].Cursor()
+		next := cursor.Next
+		var key []byte
+		if direction == Desc {
+			next = cursor.Prev
+			// Find the first key after the keys we want, and step back from it.
+			end := append([]byte{}, prefix...)
+			if after == nil {
+				end[len(end)-1]++
+				key, _ = cursor.Seek(end)
+			} else {
+				end = append(end, tupleBytes(after)...)
+				for key, _ = cursor.Seek(end); key != nil && bytes.HasPrefix(key, end); key, _ = cursor.Next() {
+				}
+			}
+			if key == nil {
+				key, _ = cursor.Last()
+			} else {
+				key, _ = cursor.Prev()
+			}
+		} else {
+			start := prefix
+			if after != nil {
+				start = append(append([]byte{}, prefix...), tupleBytes(after)...)
+			}
+			key, _ = cursor.Seek(start)
+		}
+		var value []byte
+		var sources []setop.SetOpSource
+		flush := func() (bool, error) {
+			if len(sources) == 1 {
+				return f(value, sources[0])
+			}
+			return f(value, setop.SetOpSource{
+				SetOp: &setop.SetOp{
+					Sources: sources,
+					Merge:   setop.First,
+					Type:    setop.Union,
+				},
+			})
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix); key, _ = next() {
+			part, _ := tuplePart(key[len(prefix):])
+			if sources != nil && !bytes.Equal(part, value) {
+				cont := false
+				if cont, err = flush(); err != nil || !cont {
+					return
+				}
+				sources = nil
+			}
+			value = part
+			sources = append(sources, setop.SetOpSource{
+				Key: joinKeys([][]byte{secondaryIndex, []byte(typ.Name()), self.bucket(), key}),
+			})
+		}
+		if sources != nil {
+			_, err = flush()
+		}
+		return
+	}
+}
@@ -0,0 +1,72 @@
+package unbolted
+
+import (
+	"reflect"
+
+	"github.com/zond/setop"
+)
+
+/*
+Filter can be implemented by custom filters, which are used in queries and subscriptions after being wrapped with Custom.
+Match returns whether value, a struct of type typ, matches the filter.
+Filters that only implement Filter are matched against all objects of the type, or against the objects found by the other filters they are combined with using And.
+*/
+type Filter interface {
+	Match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error)
+}
+
+/*
+SourceFilter can be implemented by custom filters that can find the objects they match without matching all objects of the type.
+Source returns a source of the Ids of the objects, for example one created by TX.Source from other filters.
+If exact is false, the objects from the source will also be matched with Match.
+*/
+type SourceFilter interface {
+	Filter
+	Source(tx *TX, typ reflect.Type) (result setop.SetOpSource, exact bool, err error)
+}
+
+/*
+Custom returns a QFilter using filter, which can be combined with other QFilters.
+*/
+func Custom(filter Filter) QFilter {
+	return customFilter{
+		Filter: filter,
+	}
+}
+
+type customFilter struct {
+	Filter
+}
+
+func (self customFilter) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return planSource(tx, typ, self)
+}
+
+func (self customFilter) plan(tx *TX, typ reflect.Type) (result *setop.SetOpSource, residual QFilter, err error) {
+	sourceFilter, ok := self.Filter.(SourceFilter)
+	if !ok {
+		residual = self
+		return
+	}
+	source, exact, err := sourceFilter.Source(tx, typ)
+	if err != nil {
+		return
+	}
+	result = &source
+	if !exact {
+		residual = self
+	}
+	return
+}
+
+func (self customFilter) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.Filter.Match(tx, typ, value)
+}
+
+/*
+Source returns a source of the Ids of the objects of typ matching filter, for use by custom filters.
+It returns an ErrNotIndexed if parts of filter can't use any index.
+*/
+func (self *TX) Source(typ reflect.Type, filter QFilter) (result setop.SetOpSource, err error) {
+	return planSource(self, typ, filter)
+}
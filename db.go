@@ -212,5 +212,8 @@ func (self *DB) Query() *Query {
 		run: func(f func(*TX) error) error {
 			return self.View(f)
 		},
+		update: func(f func(*TX) error) error {
+			return self.Update(f)
+		},
 	}
 }
@@ -0,0 +1,308 @@
+package unbolted
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zond/setop"
+)
+
+/*
+Plan is a node in the tree of set operations a query runs.
+Operation is "union", "intersection" or "difference" for nodes combining their Sources, and "source" or "empty" for leaves.
+Key names the bucket a leaf reads, as a slash separated path.
+Examined is the number of keys read from the bucket of a leaf, or the number of values visited in a walked index, and Duration the time spent reading the keys of a leaf.
+They are only set by Query.Profile.
+The keys read from a leaf include the ones read when the leaf is also a value of a walked index, since they are read by the same set operation.
+*/
+type Plan struct {
+	Operation string
+	Key       string
+	Sources   []*Plan
+	Examined  int
+	Duration  time.Duration
+}
+
+func (self *Plan) String() string {
+	buf := &bytes.Buffer{}
+	self.describe(buf, "")
+	return buf.String()
+}
+
+func (self *Plan) describe(buf *bytes.Buffer, indent string) {
+	fmt.Fprintf(buf, "%v%v", indent, self.Operation)
+	if self.Key != "" {
+		fmt.Fprintf(buf, " %v", self.Key)
+	}
+	if self.Duration > 0 {
+		fmt.Fprintf(buf, " (%v examined in %v)", self.Examined, self.Duration)
+	} else if self.Examined > 0 {
+		fmt.Fprintf(buf, " (%v examined)", self.Examined)
+	}
+	fmt.Fprintln(buf)
+	for _, source := range self.Sources {
+		source.describe(buf, indent+"  ")
+	}
+}
+
+/*
+Explanation describes how a query finds its results.
+Plan is the set operation using indexes, and Residual the filter that has to be matched against each object it finds, if any.
+Orders describes how the results are ordered, and Walked the index buckets walked to order them, with the number of values visited in each.
+Results and Duration are only set by Query.Profile.
+*/
+type Explanation struct {
+	Plan     *Plan
+	Residual string
+	Orders   []string
+	Ranked   bool
+	Walked   []*Plan
+	Results  int
+	Duration time.Duration
+}
+
+func (self *Explanation) String() string {
+	buf := &bytes.Buffer{}
+	self.Plan.describe(buf, "")
+	if self.Residual != "" {
+		fmt.Fprintf(buf, "matching %v\n", self.Residual)
+	}
+	if len(self.Orders) > 0 {
+		fmt.Fprintf(buf, "ordered by %v\n", strings.Join(self.Orders, ", "))
+	}
+	for _, walked := range self.Walked {
+		walked.describe(buf, "  ")
+	}
+	if self.Ranked {
+		fmt.Fprintln(buf, "ranked by term frequency")
+	}
+	if self.Duration > 0 {
+		fmt.Fprintf(buf, "%v results in %v\n", self.Results, self.Duration)
+	}
+	return buf.String()
+}
+
+/*
+describeKey returns a readable version of a source key.
+*/
+func describeKey(key []byte) string {
+	if span, ok := parseSpan(key); ok {
+		return span.String()
+	}
+	parts := splitKeys(key)
+	names := make([]string, len(parts))
+	for index, part := range parts {
+		if index < 3 {
+			names[index] = string(part)
+		} else {
+			names[index] = fmt.Sprintf("%q", part)
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+/*
+planOf returns the Plan for source, using examined and elapsed to find the number of keys read from each bucket and the time it took.
+*/
+func planOf(source setop.SetOpSource, examined map[string]int, elapsed map[string]time.Duration) (result *Plan) {
+	result = &Plan{}
+	if source.SetOp == nil {
+		if bytes.Equal(source.Key, emptySource.Key) {
+			result.Operation = "empty"
+			return
+		}
+		result.Operation = "source"
+		result.Key = describeKey(source.Key)
+		result.Examined = examined[string(source.Key)]
+		result.Duration = elapsed[string(source.Key)]
+		return
+	}
+	switch source.SetOp.Type {
+	case setop.Union:
+		result.Operation = "union"
+	case setop.Intersection:
+		result.Operation = "intersection"
+	case setop.Difference:
+		result.Operation = "difference"
+	default:
+		result.Operation = fmt.Sprint(source.SetOp.Type)
+	}
+	for _, child := range source.SetOp.Sources {
+		result.Sources = append(result.Sources, planOf(child, examined, elapsed))
+	}
+	return
+}
+
+/*
+countingSkipper counts the distinct keys yielded by a skipper, and the time spent skipping.
+*/
+type countingSkipper struct {
+	setop.Skipper
+	examined map[string]int
+	elapsed  map[string]time.Duration
+	key      string
+	last     []byte
+}
+
+func (self *countingSkipper) Skip(min []byte, inc bool) (result *setop.SetOpResult, err error) {
+	start := time.Now()
+	result, err = self.Skipper.Skip(min, inc)
+	self.elapsed[self.key] += time.Now().Sub(start)
+	if err != nil || result == nil {
+		return
+	}
+	if !bytes.Equal(result.Key, self.last) {
+		self.last = result.Key
+		self.examined[self.key]++
+	}
+	return
+}
+
+/*
+indexSkipper creates skippers like TX.skipper, but counts the keys they yield if the run is profiled.
+*/
+func (self *queryRun) indexSkipper(b []byte) (result setop.Skipper, err error) {
+	if result, err = self.tx.skipper(b); err != nil {
+		return
+	}
+	return self.counted(b, result), nil
+}
+
+/*
+counted returns a skipper counting the keys yielded by s, which was created for b, and the time spent skipping, if the run is profiled.
+*/
+func (self *queryRun) counted(b []byte, s setop.Skipper) setop.Skipper {
+	if self.examined == nil {
+		return s
+	}
+	return &countingSkipper{
+		Skipper:  s,
+		examined: self.examined,
+		elapsed:  self.elapsed,
+		key:      string(b),
+	}
+}
+
+/*
+explanation returns the Explanation of op, using the keys counted and the time measured during the run if it was profiled.
+*/
+func (self *queryRun) explanation(op *setop.SetOp) (result *Explanation) {
+	result = &Explanation{
+		Plan:   planOf(setop.SetOpSource{SetOp: op}, self.examined, self.elapsed),
+		Ranked: self.query.rank,
+	}
+	if self.residual != nil {
+		result.Residual = fmt.Sprintf("%+v", self.residual)
+	}
+	for _, o := range self.query.orders {
+		direction := "asc"
+		if o.direction == Desc {
+			direction = "desc"
+		}
+		result.Orders = append(result.Orders, fmt.Sprintf("%v %v", o.field, direction))
+	}
+	for bucket, visited := range self.walked {
+		result.Walked = append(result.Walked, &Plan{
+			Operation: "walk",
+			Key:       bucket,
+			Examined:  visited,
+		})
+	}
+	sort.Sort(plansByKey(result.Walked))
+	return
+}
+
+/*
+walkedBucket returns the readable name of the index bucket containing the value bucket key.
+*/
+func walkedBucket(key []byte) string {
+	parts := splitKeys(key)
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	return describeKey(joinKeys(parts))
+}
+
+type plansByKey []*Plan
+
+func (self plansByKey) Len() int {
+	return len(self)
+}
+
+func (self plansByKey) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self plansByKey) Less(i, j int) bool {
+	return self[i].Key < self[j].Key
+}
+
+/*
+Explain returns how this query would find objects of the same type as obj, without running it.
+*/
+func (self *Query) Explain(obj interface{}) (result *Explanation, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	err = self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+		}
+		if err = run.parseToken(); err != nil {
+			return
+		}
+		var op *setop.SetOp
+		if op, err = run.op(); err != nil {
+			return
+		}
+		result = run.explanation(op)
+		return
+	})
+	return
+}
+
+/*
+Profile runs this query for objects of the same type as obj, and returns how it found them, how many keys it read from each bucket and how long that took, how many results it found and how long it took in total.
+*/
+func (self *Query) Profile(obj interface{}) (result *Explanation, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	err = self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query:    self,
+			tx:       tx,
+			examined: map[string]int{},
+			elapsed:  map[string]time.Duration{},
+			walked:   map[string]int{},
+		}
+		start := time.Now()
+		results := 0
+		if err = run.each(func(elementPointer reflect.Value) (bool, error) {
+			results++
+			return true, nil
+		}); err != nil {
+			return
+		}
+		duration := time.Now().Sub(start)
+		var op *setop.SetOp
+		// Planning again creates the same op as the run did, without changing the counts.
+		if op, err = run.op(); err != nil {
+			return
+		}
+		result = run.explanation(op)
+		result.Results = results
+		result.Duration = duration
+		return
+	})
+	return
+}
@@ -0,0 +1,200 @@
+package unbolted
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/zond/setop"
+)
+
+/*
+Facet is a distinct value of an indexed field, and the number of objects having it.
+*/
+type Facet struct {
+	Value interface{}
+	Count int
+}
+
+/*
+Distinct returns the distinct values of the indexed field of objects of the same type as obj, in index order.
+*/
+func (self *TX) Distinct(obj interface{}, field string) (result []interface{}, err error) {
+	facets, err := self.Facets(obj, field, nil)
+	if err != nil {
+		return
+	}
+	for _, facet := range facets {
+		result = append(result, facet.Value)
+	}
+	return
+}
+
+/*
+Facets returns the distinct values of the indexed field of objects of the same type as obj, in index order, and the number of objects having each of them.
+If query is not nil, only the objects matching it are counted, and values no such object has are left out.
+The query is run once, decoding only the field of its results, and respects its Limit.
+The values are loaded from the first object having them, so values of fields annotated with `unbolted:"fold"` are returned as one of the unfolded values.
+*/
+func (self *TX) Facets(obj interface{}, field string, query *Query) (result []Facet, err error) {
+	value, _, err := identify(obj)
+	if err != nil {
+		return
+	}
+	typ := value.Type()
+	f, canonical, err := resolveField(typ, field)
+	if err != nil {
+		return
+	}
+	if !indexed(typ, field) {
+		err = fmt.Errorf("%v.%v is not indexed", typ.Name(), field)
+		return
+	}
+	if mapped(f.Type) {
+		err = fmt.Errorf("%v.%v is a map, and has no distinct values", typ.Name(), field)
+		return
+	}
+	if query != nil {
+		return self.queryFacets(typ, pathField{canonical, f}, query)
+	}
+	buckets, err := self.dig([][]byte{secondaryIndex, []byte(typ.Name()), []byte(canonical)}, false)
+	if err != nil {
+		if err == ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	cursor := buckets[len(buckets)-1].Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		bucket := buckets[len(buckets)-1].Bucket(key)
+		if bucket == nil {
+			continue
+		}
+		facet := Facet{
+			Count: self.cardinality(setop.SetOpSource{
+				Key: joinKeys([][]byte{secondaryIndex, []byte(typ.Name()), []byte(canonical), key}),
+			}),
+		}
+		if facet.Count == unknownCardinality {
+			facet.Count = 0
+			ids := bucket.Cursor()
+			for id, _ := ids.First(); id != nil; id, _ = ids.Next() {
+				facet.Count++
+			}
+		}
+		if facet.Count == 0 {
+			continue
+		}
+		if facet.Value, err = self.facetValue(typ, pathField{canonical, f}, key, bucket); err != nil {
+			return
+		}
+		result = append(result, facet)
+	}
+	return
+}
+
+/*
+queryFacets returns the facets of field among the results of query, by running it once and counting the indexed values of each result.
+*/
+func (self *TX) queryFacets(typ reflect.Type, field pathField, query *Query) (result []Facet, err error) {
+	query.typ = typ
+	run := &queryRun{
+		query:     query,
+		tx:        self,
+		unordered: query.limit == 0 && query.after == "",
+		fields:    []string{field.path},
+	}
+	byKey := map[string]int{}
+	var keys []string
+	if err = run.each(func(elementPointer reflect.Value) (cont bool, err error) {
+		value := fieldValue(elementPointer.Elem(), field.path, field.field.Type)
+		valueType := field.field.Type
+		values := []reflect.Value{value}
+		if multiValued(valueType) {
+			valueType = valueType.Elem()
+			values = nil
+			for index := 0; index < value.Len(); index++ {
+				values = append(values, value.Index(index))
+			}
+		}
+		// Objects are only in the value bucket of repeated elements once, so they are only counted once.
+		counted := map[string]bool{}
+		for _, v := range values {
+			var b []byte
+			if b, err = indexBytes(valueType, indexValue(field.field, v)); err != nil {
+				return
+			}
+			if counted[string(b)] {
+				continue
+			}
+			counted[string(b)] = true
+			index, found := byKey[string(b)]
+			if !found {
+				index = len(result)
+				byKey[string(b)] = index
+				keys = append(keys, string(b))
+				result = append(result, Facet{
+					Value: v.Interface(),
+				})
+			}
+			result[index].Count++
+		}
+		cont = true
+		return
+	}); err != nil {
+		return
+	}
+	sort.Sort(facetsByKey{
+		facets: result,
+		keys:   keys,
+	})
+	return
+}
+
+type facetsByKey struct {
+	facets []Facet
+	keys   []string
+}
+
+func (self facetsByKey) Len() int {
+	return len(self.facets)
+}
+
+func (self facetsByKey) Swap(i, j int) {
+	self.facets[i], self.facets[j] = self.facets[j], self.facets[i]
+	self.keys[i], self.keys[j] = self.keys[j], self.keys[i]
+}
+
+func (self facetsByKey) Less(i, j int) bool {
+	return self.keys[i] < self.keys[j]
+}
+
+/*
+facetValue returns the value of field indexed as key, by loading the first object in the value bucket of key.
+*/
+func (self *TX) facetValue(typ reflect.Type, field pathField, key []byte, bucket *bolt.Bucket) (result interface{}, err error) {
+	id, _ := bucket.Cursor().First()
+	obj := reflect.New(typ)
+	if err = self.get(id, obj.Elem(), obj.Interface()); err != nil {
+		return
+	}
+	value := fieldValue(obj.Elem(), field.path, field.field.Type)
+	if !multiValued(field.field.Type) {
+		result = value.Interface()
+		return
+	}
+	for index := 0; index < value.Len(); index++ {
+		var b []byte
+		if b, err = indexBytes(field.field.Type.Elem(), indexValue(field.field, value.Index(index))); err != nil {
+			return
+		}
+		if bytes.Equal(b, key) {
+			result = value.Index(index).Interface()
+			return
+		}
+	}
+	err = fmt.Errorf("%v.%v of %v is not indexed correctly", typ.Name(), field.path, Id(id))
+	return
+}
@@ -0,0 +1,112 @@
+package unbolted
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+const fold = "fold"
+
+/*
+accents maps lower case latin letters with diacritics to the letters they are folded to.
+*/
+var accents = map[rune]string{}
+
+func init() {
+	for folded, runes := range map[string]string{
+		"a":  "àáâãäåāăą",
+		"c":  "çćĉċč",
+		"d":  "ďđð",
+		"e":  "èéêëēĕėęě",
+		"g":  "ĝğġģ",
+		"h":  "ĥħ",
+		"i":  "ìíîïĩīĭįı",
+		"j":  "ĵ",
+		"k":  "ķ",
+		"l":  "ĺļľŀł",
+		"n":  "ñńņňŉ",
+		"o":  "òóôõöøōŏő",
+		"r":  "ŕŗř",
+		"s":  "śŝşšſ",
+		"t":  "ţťŧ",
+		"u":  "ùúûüũūŭůűų",
+		"w":  "ŵ",
+		"y":  "ýÿŷ",
+		"z":  "źżž",
+		"ae": "æ",
+		"oe": "œ",
+		"ij": "ĳ",
+		"ss": "ß",
+		"th": "þ",
+	} {
+		for _, r := range runes {
+			accents[r] = folded
+		}
+	}
+}
+
+/*
+foldString returns s in lower case, with the diacritics of latin letters and all combining marks removed.
+*/
+func foldString(s string) string {
+	buf := &bytes.Buffer{}
+	for _, r := range strings.ToLower(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if folded, found := accents[r]; found {
+			buf.WriteString(folded)
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+/*
+foldValue returns a copy of value with foldString applied to it, if it is a string, a pointer to a string or a slice of strings.
+*/
+func foldValue(value reflect.Value) reflect.Value {
+	if !value.IsValid() {
+		return value
+	}
+	typ := value.Type()
+	switch typ.Kind() {
+	case reflect.String:
+		if typ.Implements(indexerType) || reflect.PtrTo(typ).Implements(indexerType) {
+			return value
+		}
+		result := reflect.New(typ).Elem()
+		result.SetString(foldString(value.String()))
+		return result
+	case reflect.Ptr:
+		if value.IsNil() || typ.Elem().Kind() != reflect.String {
+			return value
+		}
+		result := reflect.New(typ.Elem())
+		result.Elem().Set(foldValue(value.Elem()))
+		return result
+	case reflect.Slice:
+		if typ.Elem().Kind() != reflect.String {
+			return value
+		}
+		result := reflect.MakeSlice(typ, value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			result.Index(i).Set(foldValue(value.Index(i)))
+		}
+		return result
+	}
+	return value
+}
+
+/*
+indexValue returns the value field would be indexed as, which is the folded value for fields annotated with `unbolted:"fold"`.
+*/
+func indexValue(field reflect.StructField, value reflect.Value) reflect.Value {
+	if hasParam(field, fold) {
+		return foldValue(value)
+	}
+	return value
+}
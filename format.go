@@ -0,0 +1,116 @@
+package unbolted
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/boltdb/bolt"
+)
+
+var metaKey = []byte("meta")
+var indexFormatKey = []byte("indexFormat")
+
+/*
+indexFormat is the version of the index encodings and cardinality counts written by this package.
+Indexes without a version were written before ints were encoded sign flipped, so they don't sort negative ints first, and have no counts.
+*/
+var indexFormat = []byte{2}
+
+/*
+ErrIndexFormat is returned when using indexes written by an older version of this package, which have to be rebuilt with DB.Reindex first.
+*/
+var ErrIndexFormat = fmt.Errorf("The indexes are in an older format, and have to be rebuilt with DB.Reindex")
+
+/*
+checkFormat returns ErrIndexFormat if the indexes in this TX are in an older format.
+If there are no indexes yet and create is set, they are marked as being in the current format, since they are about to be created.
+*/
+func (self *TX) checkFormat(create bool) (err error) {
+	if self.formatChecked {
+		return
+	}
+	if self.tx.Bucket(secondaryIndex) == nil {
+		if !create {
+			return
+		}
+		var meta *bolt.Bucket
+		if meta, err = self.tx.CreateBucketIfNotExists(metaKey); err != nil {
+			return
+		}
+		if err = meta.Put(indexFormatKey, indexFormat); err != nil {
+			return
+		}
+	} else if meta := self.tx.Bucket(metaKey); meta == nil || !bytes.Equal(meta.Get(indexFormatKey), indexFormat) {
+		return ErrIndexFormat
+	}
+	self.formatChecked = true
+	return
+}
+
+/*
+reindex drops all indexes and cardinality counts in this TX, and indexes the stored objects of types again.
+*/
+func (self *TX) reindex(types []reflect.Type) (err error) {
+	if indexes := self.tx.Bucket(secondaryIndex); indexes != nil {
+		byName := map[string]bool{}
+		for _, typ := range types {
+			byName[typ.Name()] = true
+		}
+		cursor := indexes.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			if !byName[string(key)] {
+				return fmt.Errorf("%v has indexes, and has to be reindexed with the other types", string(key))
+			}
+		}
+		if err = self.tx.DeleteBucket(secondaryIndex); err != nil {
+			return
+		}
+	}
+	if self.tx.Bucket(cardinalityKey) != nil {
+		if err = self.tx.DeleteBucket(cardinalityKey); err != nil {
+			return
+		}
+	}
+	self.formatChecked = false
+	for _, typ := range types {
+		objects := self.tx.Bucket(primaryKey)
+		if objects != nil {
+			objects = objects.Bucket([]byte(typ.Name()))
+		}
+		if objects == nil {
+			continue
+		}
+		cursor := objects.Cursor()
+		for id, b := cursor.First(); id != nil; id, b = cursor.Next() {
+			obj := reflect.New(typ)
+			if err = json.Unmarshal(b, obj.Interface()); err != nil {
+				return
+			}
+			if err = self.index(id, obj.Elem(), typ); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+Reindex will rebuild all indexes and cardinality counts from the stored objects of the same types as objs, in the current format.
+It has to be run once when opening a database whose indexes were written by an older version of this package,
+and all types having indexes must be given, since their indexes are all rebuilt at once.
+*/
+func (self *DB) Reindex(objs ...interface{}) (err error) {
+	var types []reflect.Type
+	for _, obj := range objs {
+		var value reflect.Value
+		if value, _, err = identify(obj); err != nil {
+			return
+		}
+		types = append(types, value.Type())
+	}
+	return self.Update(func(tx *TX) error {
+		return tx.reindex(types)
+	})
+}
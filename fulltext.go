@@ -0,0 +1,304 @@
+package unbolted
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/zond/setop"
+)
+
+const (
+	fulltext       = "fulltext"
+	fulltextPrefix = "fulltext:"
+)
+
+var fulltextFieldsCache typeCache
+
+/*
+fulltextFields returns the fields of typ, and of all structs nested or embedded in it, annotated with `unbolted:"fulltext"`.
+*/
+func fulltextFields(typ reflect.Type) []pathField {
+	return fulltextFieldsCache.get(typ, func() interface{} {
+		var result []pathField
+		walkFields(typ, func(field pathField) {
+			if hasParam(field.field, fulltext) {
+				result = append(result, field)
+			}
+		})
+		return result
+	}).([]pathField)
+}
+
+/*
+fulltextBucket returns the name of the bucket containing the posting lists of the field at the canonical path, which can't collide with field names since it contains a colon.
+*/
+func fulltextBucket(canonical string) []byte {
+	return []byte(fulltextPrefix + canonical)
+}
+
+/*
+stem removes common english inflection suffixes from word, so that for example "jumps", "jumped" and "jumping" all become "jump".
+*/
+func stem(word string) string {
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		word = word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "xes") || strings.HasSuffix(word, "ches") || strings.HasSuffix(word, "shes"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s") && len(word) > 3:
+		word = word[:len(word)-1]
+	}
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		if strings.HasSuffix(word, suffix) && len(word)-len(suffix) >= 3 && strings.ContainsAny(word[:len(word)-len(suffix)], "aeiouy") {
+			word = word[:len(word)-len(suffix)]
+			// Undouble the consonant doubled by the suffix, as in "running".
+			if last := len(word) - 1; suffix != "ly" && word[last] == word[last-1] && !strings.ContainsAny(word[last:], "aeiouylsz") {
+				word = word[:last]
+			}
+			break
+		}
+	}
+	return word
+}
+
+/*
+tokenize splits s into words, folds them like `unbolted:"fold"` fields and stems them.
+*/
+func tokenize(s string) (result []string) {
+	for _, word := range strings.FieldsFunc(foldString(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		result = append(result, stem(word))
+	}
+	return
+}
+
+/*
+termFrequencies returns the number of times each term occurs in the text of value, which must be a string or a pointer to a string.
+*/
+func termFrequencies(value reflect.Value) (result map[string]uint32, err error) {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.String {
+		err = fmt.Errorf("%v is not a string type, and can't be full text indexed", value.Type())
+		return
+	}
+	result = map[string]uint32{}
+	for _, term := range tokenize(value.String()) {
+		result[term]++
+	}
+	return
+}
+
+/*
+fulltextKeys returns the posting list entries of value, one for each term in each field annotated with `unbolted:"fulltext"`, and the frequency of the term in the field.
+*/
+func fulltextKeys(id []byte, value reflect.Value, typ reflect.Type) (keys [][][]byte, frequencies [][]byte, err error) {
+	for _, field := range fulltextFields(typ) {
+		var terms map[string]uint32
+		if terms, err = termFrequencies(fieldValue(value, field.path, field.field.Type)); err != nil {
+			return
+		}
+		for term, frequency := range terms {
+			keys = append(keys, [][]byte{
+				secondaryIndex,
+				[]byte(typ.Name()),
+				fulltextBucket(field.path),
+				[]byte(term),
+				id,
+			})
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, frequency)
+			frequencies = append(frequencies, b)
+		}
+	}
+	return
+}
+
+/*
+Match is a QFilter that matches objects where the field Field, annotated with `unbolted:"fulltext"`, contains all the terms in Query.
+Terms are compared case and accent insensitively, and after removing common english inflection suffixes.
+*/
+type Match struct {
+	Field string
+	Query string
+}
+
+func (self Match) terms(typ reflect.Type) (result []string, canonical string, err error) {
+	field, canonical, err := resolveField(typ, self.Field)
+	if err != nil {
+		return
+	}
+	if !hasParam(field, fulltext) {
+		err = fmt.Errorf("%v.%v is not annotated with `unbolted:\"fulltext\"`", typ.Name(), self.Field)
+		return
+	}
+	seen := map[string]bool{}
+	for _, term := range tokenize(self.Query) {
+		if !seen[term] {
+			seen[term] = true
+			result = append(result, term)
+		}
+	}
+	return
+}
+
+func (self Match) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	terms, canonical, err := self.terms(typ)
+	if err != nil {
+		return
+	}
+	if len(terms) == 0 {
+		result = emptySource
+		return
+	}
+	op := setop.SetOp{
+		Merge: setop.First,
+		Type:  setop.Intersection,
+	}
+	for _, term := range terms {
+		op.Sources = append(op.Sources, setop.SetOpSource{
+			Key: joinKeys([][]byte{secondaryIndex, []byte(typ.Name()), fulltextBucket(canonical), []byte(term)}),
+		})
+	}
+	result.SetOp = &op
+	return
+}
+
+func (self Match) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	terms, _, err := self.terms(typ)
+	if err != nil || len(terms) == 0 {
+		return
+	}
+	field, err := fieldByName(value, self.Field)
+	if err != nil {
+		return
+	}
+	frequencies, err := termFrequencies(field)
+	if err != nil {
+		return
+	}
+	for _, term := range terms {
+		if frequencies[term] == 0 {
+			return
+		}
+	}
+	result = true
+	return
+}
+
+/*
+score returns the sum of the frequencies of the terms of this Match in the object with id.
+*/
+func (self Match) score(tx *TX, typ reflect.Type, id []byte) (result int, err error) {
+	terms, canonical, err := self.terms(typ)
+	if err != nil {
+		return
+	}
+	for _, term := range terms {
+		var buckets []*bolt.Bucket
+		if buckets, err = tx.dig([][]byte{secondaryIndex, []byte(typ.Name()), fulltextBucket(canonical), []byte(term)}, false); err != nil {
+			if err == ErrNotFound {
+				err = nil
+				continue
+			}
+			return
+		}
+		if b := buckets[len(buckets)-1].Get(id); len(b) == 4 {
+			result += int(binary.BigEndian.Uint32(b))
+		}
+	}
+	return
+}
+
+/*
+matches returns all Match filters in filter that aren't negated.
+*/
+func matches(filter QFilter) (result []Match) {
+	switch f := filter.(type) {
+	case Match:
+		result = append(result, f)
+	case And:
+		for _, child := range f {
+			result = append(result, matches(child)...)
+		}
+	case Or:
+		for _, child := range f {
+			result = append(result, matches(child)...)
+		}
+	}
+	return
+}
+
+type rankedKV struct {
+	kv
+	score int
+}
+
+type rankedKVs []rankedKV
+
+func (self rankedKVs) Len() int {
+	return len(self)
+}
+
+func (self rankedKVs) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self rankedKVs) Less(i, j int) bool {
+	if self[i].score != self[j].score {
+		return self[i].score > self[j].score
+	}
+	return string(self[i].Keys[0]) < string(self[j].Keys[0])
+}
+
+/*
+eachRanked runs f with the results of op, with the ones where the Match filters of the query have the highest term frequencies first.
+*/
+func (self *queryRun) eachRanked(op *setop.SetOp, f func(kv kv) (bool, error)) (err error) {
+	if len(self.query.orders) > 0 || self.query.after != "" {
+		return fmt.Errorf("ranked queries can't be ordered or continued after a token")
+	}
+	typ := self.query.typ
+	filters := matches(self.query.intersection)
+	var ranked rankedKVs
+	if err = self.tx.setOp(&setop.SetExpression{
+		Op: op,
+	}, self.skipper, func(kv kv) (cont bool, err error) {
+		r := rankedKV{
+			kv: kv,
+		}
+		for _, filter := range filters {
+			score := 0
+			if score, err = filter.score(self.tx, typ, kv.Keys[0]); err != nil {
+				return
+			}
+			r.score += score
+		}
+		ranked = append(ranked, r)
+		cont = true
+		return
+	}); err != nil {
+		return
+	}
+	sort.Sort(ranked)
+	for _, r := range ranked {
+		cont := false
+		if cont, err = f(r.kv); err != nil || !cont {
+			return
+		}
+	}
+	return
+}
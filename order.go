@@ -0,0 +1,265 @@
+package unbolted
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/zond/setop"
+)
+
+/*
+Direction defines in what order query results are returned.
+*/
+type Direction int
+
+const (
+	// Asc returns the smallest values first.
+	Asc Direction = iota
+	// Desc returns the largest values first.
+	Desc
+)
+
+type order struct {
+	field     string
+	direction Direction
+}
+
+type orderedKV struct {
+	kv
+	sortKeys [][]byte
+}
+
+type orderedKVs struct {
+	kvs    []orderedKV
+	orders []order
+}
+
+func (self orderedKVs) Len() int {
+	return len(self.kvs)
+}
+
+func (self orderedKVs) Swap(i, j int) {
+	self.kvs[i], self.kvs[j] = self.kvs[j], self.kvs[i]
+}
+
+func (self orderedKVs) Less(i, j int) bool {
+	return self.less(&self.kvs[i], &self.kvs[j])
+}
+
+func (self orderedKVs) less(a, b *orderedKV) bool {
+	for index, o := range self.orders {
+		if cmp := bytes.Compare(a.sortKeys[index], b.sortKeys[index]); cmp != 0 {
+			if o.direction == Desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+	}
+	return bytes.Compare(a.Keys[0], b.Keys[0]) < 0
+}
+
+/*
+sortGroup sorts a group of results sharing the same value for the first order field by the remaining order fields, and then by Id.
+*/
+func (self *queryRun) sortGroup(group []kv) (result orderedKVs, err error) {
+	result.orders = self.query.orders[1:]
+	for _, kv := range group {
+		okv := orderedKV{
+			kv: kv,
+		}
+		if len(result.orders) > 0 {
+			value := reflect.New(self.query.typ)
+			if err = json.Unmarshal(kv.Value, value.Interface()); err != nil {
+				return
+			}
+			if okv.sortKeys, err = self.orderBytes(value.Elem(), result.orders); err != nil {
+				return
+			}
+		}
+		result.kvs = append(result.kvs, okv)
+	}
+	sort.Sort(result)
+	return
+}
+
+func (self *queryRun) orderBytes(value reflect.Value, orders []order) (result [][]byte, err error) {
+	for _, o := range orders {
+		var field reflect.Value
+		if field, err = indexedFieldByName(value, o.field); err != nil {
+			return
+		}
+		var b []byte
+		if b, err = indexBytes(field.Type(), field); err != nil {
+			return
+		}
+		result = append(result, b)
+	}
+	return
+}
+
+/*
+groupWalker walks groups of index entries sharing the same value in order, starting with the group for after if it is not nil.
+*/
+type groupWalker func(after []byte, f func(value []byte, source setop.SetOpSource) (bool, error)) error
+
+/*
+fieldWalker returns a groupWalker walking the value buckets of the index of a field.
+*/
+func (self *queryRun) fieldWalker(o order) groupWalker {
+	return func(after []byte, f func(value []byte, source setop.SetOpSource) (bool, error)) (err error) {
+		typ := self.query.typ
+		field := canonicalField(typ, o.field)
+		buckets, err := self.tx.dig([][]byte{secondaryIndex, []byte(typ.Name()), []byte(field)}, false)
+		if err != nil {
+			if err == ErrNotFound {
+				err = nil
+			}
+			return
+		}
+		cursor := buckets[len(buckets)-1].Cursor()
+		next := cursor.Next
+		var key []byte
+		if after == nil {
+			if o.direction == Desc {
+				key, _ = cursor.Last()
+			} else {
+				key, _ = cursor.First()
+			}
+		} else {
+			key, _ = cursor.Seek(after)
+			if o.direction == Desc {
+				if key == nil {
+					key, _ = cursor.Last()
+				} else if !bytes.Equal(key, after) {
+					key, _ = cursor.Prev()
+				}
+			}
+		}
+		if o.direction == Desc {
+			next = cursor.Prev
+		}
+		for ; key != nil; key, _ = next() {
+			cont := false
+			if cont, err = f(key, setop.SetOpSource{
+				Key: joinKeys([][]byte{secondaryIndex, []byte(typ.Name()), []byte(field), key}),
+			}); err != nil || !cont {
+				return
+			}
+		}
+		return
+	}
+}
+
+/*
+compositeWalker returns a groupWalker for a composite index whose leading fields are covered by Equals in the query, and whose next field is o.
+*/
+func (self *queryRun) compositeWalker(o order) (result groupWalker, found bool, err error) {
+	var filters []QFilter
+	switch filter := self.query.intersection.(type) {
+	case Equals:
+		filters = []QFilter{filter}
+	case And:
+		filters = filter
+	}
+	if len(filters) == 0 {
+		return
+	}
+	for _, composite := range compositeIndexes(self.query.typ) {
+		var prefix []byte
+		var covered map[int]bool
+		if prefix, covered, err = composite.coverage(self.query.typ, filters); err != nil {
+			return
+		}
+		if len(covered) > 0 && len(covered) < len(composite.fields) && composite.fields[len(covered)].path == canonicalField(self.query.typ, o.field) {
+			return composite.walker(self.tx, self.query.typ, prefix, o.direction), true, nil
+		}
+	}
+	return
+}
+
+/*
+eachOrdered walks the index of the first order field with a cursor, and runs op once for each indexed value to find the matching results in order.
+*/
+func (self *queryRun) eachOrdered(op *setop.SetOp, f func(kv kv) (bool, error)) (err error) {
+	typ := self.query.typ
+	first := self.query.orders[0]
+	walker, found, err := self.compositeWalker(first)
+	if err != nil {
+		return
+	}
+	if !found {
+		walker = self.fieldWalker(first)
+	}
+	for index, o := range self.query.orders {
+		if (index > 0 || !found) && !indexed(typ, o.field) {
+			return fmt.Errorf("%v.%v is not indexed, and can not be ordered by", typ.Name(), o.field)
+		}
+		if field, _, err := resolveField(typ, o.field); err == nil && (multiValued(field.Type) || mapped(field.Type)) {
+			return fmt.Errorf("%v.%v is multi valued, and can not be ordered by", typ.Name(), o.field)
+		}
+	}
+	var after []byte
+	if self.after != nil {
+		after = self.after[0]
+		self.afterKV = &orderedKV{
+			kv: kv{
+				Keys: [][]byte{self.after[len(self.after)-1]},
+			},
+			sortKeys: self.after[1 : len(self.after)-1],
+		}
+	}
+	return walker(after, func(value []byte, source setop.SetOpSource) (cont bool, err error) {
+		if self.walked != nil {
+			self.walked[walkedBucket(source.Key)]++
+		}
+		f := func(kv kv) (bool, error) {
+			kv.ordered = value
+			return f(kv)
+		}
+		expr := &setop.SetExpression{
+			Op: &setop.SetOp{
+				Sources: []setop.SetOpSource{
+					setop.SetOpSource{
+						SetOp: op,
+					},
+					source,
+				},
+				Type:  setop.Intersection,
+				Merge: setop.First,
+			},
+		}
+		cont = true
+		resuming := after != nil && bytes.Equal(value, after)
+		if len(self.query.orders) == 1 && !resuming {
+			// The Ids in a value bucket are already in order, so the group can be streamed.
+			err = self.tx.setOp(expr, self.indexSkipper, func(kv kv) (bool, error) {
+				cont, err = f(kv)
+				return cont, err
+			})
+			return
+		}
+		var group []kv
+		if err = self.tx.setOp(expr, self.indexSkipper, func(kv kv) (bool, error) {
+			group = append(group, kv)
+			return true, nil
+		}); err != nil {
+			return
+		}
+		var sorted orderedKVs
+		if sorted, err = self.sortGroup(group); err != nil {
+			return
+		}
+		for index := range sorted.kvs {
+			if resuming && !sorted.less(self.afterKV, &sorted.kvs[index]) {
+				continue
+			}
+			if cont, err = f(sorted.kvs[index].kv); err != nil || !cont {
+				return
+			}
+		}
+		return
+	})
+}
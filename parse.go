@@ -0,0 +1,418 @@
+package unbolted
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+token is a lexical token of the query language, and the position in the query where it starts.
+*/
+type token struct {
+	text     string
+	quoted   bool
+	position int
+}
+
+/*
+lex splits query into identifiers, quoted strings, numbers, operators and parentheses.
+*/
+func lex(query string) (result []token, err error) {
+	runes := []rune(query)
+	for index := 0; index < len(runes); {
+		r := runes[index]
+		start := index
+		switch {
+		case unicode.IsSpace(r):
+			index++
+			continue
+		case r == '"':
+			for index++; index < len(runes) && runes[index] != '"'; index++ {
+				if runes[index] == '\\' {
+					index++
+				}
+			}
+			if index >= len(runes) {
+				err = fmt.Errorf("unterminated string at %v in %v", start, query)
+				return
+			}
+			index++
+			var text string
+			if text, err = strconv.Unquote(string(runes[start:index])); err != nil {
+				err = fmt.Errorf("bad string at %v in %v: %v", start, query, err)
+				return
+			}
+			result = append(result, token{
+				text:     text,
+				quoted:   true,
+				position: start,
+			})
+			continue
+		case strings.ContainsRune("()[]=", r):
+			index++
+		case strings.ContainsRune("!<>", r):
+			index++
+			if index < len(runes) && runes[index] == '=' {
+				index++
+			} else if r == '!' {
+				err = fmt.Errorf("unexpected %q at %v in %v", r, start, query)
+				return
+			}
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-+", r):
+			for index++; index < len(runes) && (unicode.IsLetter(runes[index]) || unicode.IsDigit(runes[index]) || strings.ContainsRune("_.-+", runes[index])); index++ {
+			}
+		default:
+			err = fmt.Errorf("unexpected %q at %v in %v", r, start, query)
+			return
+		}
+		result = append(result, token{
+			text:     string(runes[start:index]),
+			position: start,
+		})
+	}
+	return
+}
+
+/*
+parser compiles a list of tokens into QFilters for typ.
+*/
+type parser struct {
+	typ    reflect.Type
+	query  string
+	tokens []token
+}
+
+func (self *parser) errorf(format string, args ...interface{}) error {
+	position := len(self.query)
+	if len(self.tokens) > 0 {
+		position = self.tokens[0].position
+	}
+	return fmt.Errorf("%v at %v in %v", fmt.Sprintf(format, args...), position, self.query)
+}
+
+/*
+peek returns whether the next token is the unquoted keyword or operator, ignoring case.
+*/
+func (self *parser) peek(keyword string) bool {
+	return len(self.tokens) > 0 && !self.tokens[0].quoted && strings.EqualFold(self.tokens[0].text, keyword)
+}
+
+func (self *parser) next() (result token, err error) {
+	if len(self.tokens) == 0 {
+		err = self.errorf("unexpected end of query")
+		return
+	}
+	result, self.tokens = self.tokens[0], self.tokens[1:]
+	return
+}
+
+func (self *parser) expect(keyword string) (err error) {
+	if !self.peek(keyword) {
+		if len(self.tokens) == 0 {
+			return self.errorf("expected %v", keyword)
+		}
+		return self.errorf("expected %v but got %q", keyword, self.tokens[0].text)
+	}
+	self.tokens = self.tokens[1:]
+	return
+}
+
+func (self *parser) or() (result QFilter, err error) {
+	var filter QFilter
+	if filter, err = self.and(); err != nil {
+		return
+	}
+	filters := Or{filter}
+	for self.peek("OR") {
+		self.tokens = self.tokens[1:]
+		if filter, err = self.and(); err != nil {
+			return
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 1 {
+		result = filters[0]
+	} else {
+		result = filters
+	}
+	return
+}
+
+func (self *parser) and() (result QFilter, err error) {
+	var filter QFilter
+	if filter, err = self.unary(); err != nil {
+		return
+	}
+	filters := And{filter}
+	for self.peek("AND") {
+		self.tokens = self.tokens[1:]
+		if filter, err = self.unary(); err != nil {
+			return
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 1 {
+		result = filters[0]
+	} else {
+		result = filters
+	}
+	return
+}
+
+func (self *parser) unary() (result QFilter, err error) {
+	if self.peek("NOT") {
+		self.tokens = self.tokens[1:]
+		var filter QFilter
+		if filter, err = self.unary(); err != nil {
+			return
+		}
+		result = Not{filter}
+		return
+	}
+	if self.peek("(") {
+		self.tokens = self.tokens[1:]
+		if result, err = self.or(); err != nil {
+			return
+		}
+		err = self.expect(")")
+		return
+	}
+	return self.comparison()
+}
+
+func (self *parser) comparison() (result QFilter, err error) {
+	name, err := self.next()
+	if err != nil {
+		return
+	}
+	if name.quoted {
+		err = fmt.Errorf("expected field name but got %q at %v in %v", name.text, name.position, self.query)
+		return
+	}
+	field, _, err := resolveField(self.typ, name.text)
+	if err != nil {
+		err = fmt.Errorf("%v at %v in %v", err, name.position, self.query)
+		return
+	}
+	if self.peek("[") {
+		self.tokens = self.tokens[1:]
+		if !mapped(field.Type) {
+			err = self.errorf("%v.%v is not a map", self.typ.Name(), name.text)
+			return
+		}
+		var key interface{}
+		if key, err = self.value(field.Type.Key()); err != nil {
+			return
+		}
+		if err = self.expect("]"); err != nil {
+			return
+		}
+		if err = self.expect("="); err != nil {
+			return
+		}
+		var value interface{}
+		if value, err = self.value(field.Type.Elem()); err != nil {
+			return
+		}
+		result = KeyEquals{name.text, key, value}
+		return
+	}
+	op, err := self.next()
+	if err != nil {
+		return
+	}
+	valueType := field.Type
+	if multiValued(valueType) {
+		valueType = valueType.Elem()
+	}
+	switch strings.ToUpper(op.text) {
+	case "HAS":
+		if !mapped(field.Type) {
+			err = self.errorf("%v.%v is not a map", self.typ.Name(), name.text)
+			return
+		}
+		var key interface{}
+		if key, err = self.value(field.Type.Key()); err != nil {
+			return
+		}
+		result = HasKey{name.text, key}
+		return
+	case "MATCH", "PREFIX":
+		var text token
+		if text, err = self.next(); err != nil {
+			return
+		}
+		if !text.quoted {
+			err = fmt.Errorf("expected string but got %v at %v in %v", text.text, text.position, self.query)
+			return
+		}
+		if strings.ToUpper(op.text) == "MATCH" {
+			result = Match{name.text, text.text}
+		} else {
+			result = Prefix{name.text, text.text}
+		}
+		return
+	}
+	var value interface{}
+	if value, err = self.value(valueType); err != nil {
+		return
+	}
+	switch strings.ToUpper(op.text) {
+	case "=":
+		result = Equals{name.text, value}
+	case "!=":
+		result = Not{Equals{name.text, value}}
+	case ">":
+		result = Greater{name.text, value}
+	case ">=":
+		result = GreaterOrEqual{name.text, value}
+	case "<":
+		result = Less{name.text, value}
+	case "<=":
+		result = LessOrEqual{name.text, value}
+	case "CONTAINS":
+		if !multiValued(field.Type) {
+			err = fmt.Errorf("%v.%v is not a slice at %v in %v", self.typ.Name(), name.text, op.position, self.query)
+			return
+		}
+		result = Contains{name.text, value}
+	default:
+		err = fmt.Errorf("unknown operator %q at %v in %v", op.text, op.position, self.query)
+	}
+	return
+}
+
+/*
+value parses the next token as a value of typ, or of the type typ points to.
+*/
+func (self *parser) value(typ reflect.Type) (result interface{}, err error) {
+	literal, err := self.next()
+	if err != nil {
+		return
+	}
+	fail := func(cause interface{}) error {
+		return fmt.Errorf("%q is not a valid %v: %v at %v in %v", literal.text, typ, cause, literal.position, self.query)
+	}
+	if typ.Kind() == reflect.Ptr {
+		if !literal.quoted && strings.EqualFold(literal.text, "null") {
+			return
+		}
+		typ = typ.Elem()
+	}
+	value := reflect.New(typ).Elem()
+	if typ == timeType {
+		if !literal.quoted {
+			err = fail("times must be quoted")
+			return
+		}
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339Nano, literal.text); err != nil {
+			err = fail(err)
+			return
+		}
+		result = t
+		return
+	}
+	if literal.quoted != (typ.Kind() == reflect.String) {
+		if literal.quoted {
+			err = fail("only strings are quoted")
+		} else {
+			err = fail("strings must be quoted")
+		}
+		return
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		value.SetString(literal.text)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(literal.text); err != nil {
+			err = fail(err)
+			return
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(literal.text, 10, typ.Bits()); err != nil {
+			err = fail(err)
+			return
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		if u, err = strconv.ParseUint(literal.text, 10, typ.Bits()); err != nil {
+			err = fail(err)
+			return
+		}
+		value.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(literal.text, typ.Bits()); err != nil {
+			err = fail(err)
+			return
+		}
+		value.SetFloat(f)
+	default:
+		err = fail("values of this type can't be written in queries")
+		return
+	}
+	result = value.Interface()
+	return
+}
+
+/*
+Parse compiles query into filters for the type of obj, validating the field names and value types against it.
+
+Queries compare fields to values with =, !=, <, <=, > and >=, elements of slice fields with CONTAINS, map keys with HAS, map values with Field["key"] = value,
+full text fields with MATCH "terms", and string prefixes with PREFIX "prefix". Strings and times (in RFC 3339 format) are quoted, nil pointers are written null,
+and comparisons can be combined with AND, OR, NOT and parentheses, with AND binding tighter than OR.
+A final EXCEPT followed by another such expression defines filters for objects to exclude.
+
+Example: Parse(&Issue{}, `Status = "open" AND (Owner = "x" OR Priority > 3) EXCEPT Archived = true`)
+*/
+func Parse(obj interface{}, query string) (where, except QFilter, err error) {
+	value, _, err := identify(obj)
+	if err != nil {
+		return
+	}
+	p := &parser{
+		typ:   value.Type(),
+		query: query,
+	}
+	if p.tokens, err = lex(query); err != nil {
+		return
+	}
+	if where, err = p.or(); err != nil {
+		return
+	}
+	if p.peek("EXCEPT") {
+		p.tokens = p.tokens[1:]
+		if except, err = p.or(); err != nil {
+			return
+		}
+	}
+	if len(p.tokens) > 0 {
+		err = p.errorf("unexpected %q", p.tokens[0].text)
+	}
+	return
+}
+
+/*
+Parse will add the filters compiled from query for the type of obj to this query.
+*/
+func (self *Query) Parse(obj interface{}, query string) (result *Query, err error) {
+	where, except, err := Parse(obj, query)
+	if err != nil {
+		return
+	}
+	self.Where(where)
+	if except != nil {
+		self.Except(except)
+	}
+	result = self
+	return
+}
@@ -0,0 +1,355 @@
+package unbolted
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/*
+Select will make this query decode only the given fields, and the Id, of its results, leaving the other fields zero.
+Fields nested in structs decode the whole top level field containing them.
+Filters that can't use indexes are still matched against the whole objects.
+If the only field selected is the one the query is ordered by, the results are loaded from the index walked to order them without decoding the objects,
+unless the field is a float, time or folded field, or uses an Indexer, whose index values can't be decoded.
+*/
+func (self *Query) Select(fields ...string) *Query {
+	self.selected = fields
+	return self
+}
+
+/*
+jsonKey returns the JSON key field is encoded as, or false if field is an embedded struct whose fields are encoded in the struct containing it.
+*/
+func jsonKey(field reflect.StructField) (result string, named bool) {
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag != "" {
+		return tag, true
+	}
+	typ := field.Type
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if field.Anonymous && typ.Kind() == reflect.Struct {
+		return
+	}
+	return field.Name, true
+}
+
+/*
+jsonKeys returns the top level JSON keys of the fields named by paths in typ.
+*/
+func jsonKeys(typ reflect.Type, paths []string) (result []string, err error) {
+	for _, path := range paths {
+		var canonical string
+		if _, canonical, err = resolveField(typ, path); err != nil {
+			return
+		}
+		parent := typ
+		for _, name := range strings.Split(canonical, ".") {
+			if parent.Kind() == reflect.Ptr {
+				parent = parent.Elem()
+			}
+			field, _ := parent.FieldByName(name)
+			if key, named := jsonKey(field); named {
+				if key == "-" {
+					err = fmt.Errorf("%v.%v is not stored", typ.Name(), path)
+					return
+				}
+				result = append(result, key)
+				break
+			}
+			parent = field.Type
+		}
+	}
+	return
+}
+
+/*
+jsonField is a field of a struct decoded from a top level JSON key, and the index path to it through the structs embedded in the struct.
+*/
+type jsonField struct {
+	key   string
+	index []int
+}
+
+var jsonFieldsCache typeCache
+
+/*
+jsonFields returns the fields of typ decoded from top level JSON keys, like encoding/json finds them,
+with the fields of embedded structs promoted unless a field closer to the top level has the same key.
+*/
+func jsonFields(typ reflect.Type) []jsonField {
+	return jsonFieldsCache.get(typ, func() interface{} {
+		type embedded struct {
+			typ   reflect.Type
+			index []int
+		}
+		var result []jsonField
+		found := map[string]bool{}
+		visited := map[reflect.Type]bool{}
+		for level := []embedded{{typ, nil}}; len(level) > 0; {
+			var next []embedded
+			var fields []jsonField
+			for _, parent := range level {
+				if visited[parent.typ] {
+					continue
+				}
+				visited[parent.typ] = true
+				for i := 0; i < parent.typ.NumField(); i++ {
+					field := parent.typ.Field(i)
+					index := append(append([]int{}, parent.index...), i)
+					key, named := jsonKey(field)
+					if !named {
+						if field.Type.Kind() == reflect.Ptr {
+							// Unexported embedded pointers can't be allocated, so encoding/json ignores them.
+							if field.PkgPath == "" {
+								next = append(next, embedded{field.Type.Elem(), index})
+							}
+						} else {
+							next = append(next, embedded{field.Type, index})
+						}
+						continue
+					}
+					if field.PkgPath == "" && key != "-" && !found[key] {
+						fields = append(fields, jsonField{key, index})
+					}
+				}
+			}
+			for _, field := range fields {
+				found[field.key] = true
+			}
+			result = append(result, fields...)
+			level = next
+		}
+		return result
+	}).([]jsonField)
+}
+
+/*
+findJSONField returns the field decoded from key, matching keys exactly if possible and ignoring case otherwise, like encoding/json.
+*/
+func findJSONField(fields []jsonField, key string) (result jsonField, found bool) {
+	for _, field := range fields {
+		if field.key == key {
+			return field, true
+		}
+	}
+	for _, field := range fields {
+		if strings.EqualFold(field.key, key) {
+			return field, true
+		}
+	}
+	return
+}
+
+/*
+settableField returns the field at index in value, allocating the nil pointers to embedded structs on the way.
+*/
+func settableField(value reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			value = value.Elem()
+		}
+		value = value.Field(x)
+	}
+	return value
+}
+
+func selected(keys []string, key string) bool {
+	for _, wanted := range keys {
+		if wanted == key {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+decode unmarshals b into obj, or only the top level JSON keys in keys if it isn't nil.
+The values of the other keys are skipped without being decoded, unless obj unmarshals itself.
+*/
+func decode(b []byte, obj interface{}, keys []string) (err error) {
+	if _, unmarshaler := obj.(json.Unmarshaler); keys == nil || unmarshaler {
+		return json.Unmarshal(b, obj)
+	}
+	value := reflect.ValueOf(obj).Elem()
+	fields := jsonFields(value.Type())
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	if _, err = decoder.Token(); err != nil {
+		return
+	}
+	var raw json.RawMessage
+	for decoder.More() {
+		var token json.Token
+		if token, err = decoder.Token(); err != nil {
+			return
+		}
+		if err = decoder.Decode(&raw); err != nil {
+			return
+		}
+		if field, found := findJSONField(fields, token.(string)); found && selected(keys, field.key) {
+			if err = json.Unmarshal(raw, settableField(value, field.index).Addr().Interface()); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+project copies the fields of source decoded from the top level JSON keys in keys to destination.
+*/
+func project(source, destination reflect.Value, keys []string) {
+	for _, field := range jsonFields(source.Type()) {
+		if !selected(keys, field.key) {
+			continue
+		}
+		if value, found := reachableField(source, field.index); found {
+			settableField(destination, field.index).Set(value)
+		}
+	}
+}
+
+/*
+reachableField returns the field at index in value, or false if a pointer to an embedded struct on the way is nil.
+*/
+func reachableField(value reflect.Value, index []int) (result reflect.Value, found bool) {
+	for i, x := range index {
+		if i > 0 && value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return
+			}
+			value = value.Elem()
+		}
+		value = value.Field(x)
+	}
+	return value, true
+}
+
+/*
+selectedPaths returns the selected fields of this run, with the Id and the given extra fields, or nil if all fields should be loaded.
+*/
+func (self *queryRun) selectedPaths(extra ...string) []string {
+	fields := self.fields
+	if fields == nil {
+		fields = self.query.selected
+	}
+	if fields == nil {
+		return nil
+	}
+	return append(append([]string{idField}, fields...), extra...)
+}
+
+/*
+coveredField returns the field that the selected paths of this run can be loaded from the index of, or nil if the results have to be decoded.
+That is the case if the paths are only the Id and the top level field the results are ordered by, so that its index is walked,
+and no residual filter needs the whole objects.
+*/
+func (self *queryRun) coveredField(paths []string) *pathField {
+	if paths == nil || self.residual != nil || self.unordered || self.query.rank || len(self.query.orders) != 1 {
+		return nil
+	}
+	field, canonical, err := resolveField(self.query.typ, self.query.orders[0].field)
+	if err != nil || strings.Contains(canonical, ".") || hasParam(field, fold) {
+		return nil
+	}
+	for _, path := range paths {
+		if _, selected, err := resolveField(self.query.typ, path); err != nil || (selected != canonical && selected != idField) {
+			return nil
+		}
+	}
+	return &pathField{canonical, field}
+}
+
+/*
+loader returns a function loading the selected fields of this run, with the Id and the given extra fields, from a result, as a pointer to a new object.
+Results found by walking the index of a covered field are loaded from the walked value when it can be decoded,
+results already decoded to be matched against a residual filter are copied,
+and other results are decoded.
+*/
+func (self *queryRun) loader(extra ...string) (result func(kv kv) (reflect.Value, error), err error) {
+	paths := self.selectedPaths(extra...)
+	var keys []string
+	if paths != nil {
+		if keys, err = jsonKeys(self.query.typ, paths); err != nil {
+			return
+		}
+	}
+	checked := false
+	var covered *pathField
+	result = func(kv kv) (obj reflect.Value, err error) {
+		if !checked {
+			// The residual filter is only known once the query is planned.
+			covered, checked = self.coveredField(paths), true
+		}
+		if covered != nil && kv.ordered != nil {
+			if value, ok := indexedValue(covered.field.Type, kv.ordered); ok {
+				obj = reflect.New(self.query.typ)
+				obj.Elem().FieldByName(idField).SetBytes(append([]byte{}, kv.Keys[0]...))
+				obj.Elem().FieldByName(covered.path).Set(value)
+				return
+			}
+		}
+		if kv.decoded.IsValid() {
+			if keys == nil {
+				return kv.decoded, nil
+			}
+			obj = reflect.New(self.query.typ)
+			project(kv.decoded.Elem(), obj.Elem(), keys)
+			return
+		}
+		obj = reflect.New(self.query.typ)
+		err = decode(kv.Value, obj.Interface(), keys)
+		return
+	}
+	return
+}
+
+/*
+Maps will return the results of this query for objects of the same type as obj as maps from the fields given to Select, and Id, to their values.
+If no fields are selected, the maps will contain all exported fields.
+*/
+func (self *Query) Maps(obj interface{}) (result []map[string]interface{}, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	paths := self.selected
+	if paths == nil {
+		for index := 0; index < self.typ.NumField(); index++ {
+			if field := self.typ.Field(index); field.PkgPath == "" && field.Name != idField {
+				paths = append(paths, field.Name)
+			}
+		}
+	}
+	err = self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query:  self,
+			tx:     tx,
+			fields: paths,
+		}
+		return run.each(func(elementPointer reflect.Value) (cont bool, err error) {
+			m := map[string]interface{}{
+				idField: Id(elementPointer.Elem().FieldByName(idField).Bytes()),
+			}
+			for _, path := range paths {
+				var fieldValue reflect.Value
+				if fieldValue, err = fieldByName(elementPointer.Elem(), path); err != nil {
+					return
+				}
+				m[path] = fieldValue.Interface()
+			}
+			result = append(result, m)
+			cont = true
+			return
+		})
+	})
+	return
+}
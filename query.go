@@ -2,9 +2,10 @@ package unbolted
 
 import (
 	"bytes"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/zond/setop"
 )
@@ -13,7 +14,7 @@ import (
 QFilters are used to filter queries
 */
 type QFilter interface {
-	source(typ reflect.Type) (result setop.SetOpSource, err error)
+	source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error)
 	match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error)
 }
 
@@ -22,95 +23,756 @@ Or is a QFilter that defineds an OR operation.
 */
 type Or []QFilter
 
-func (self Or) source(typ reflect.Type) (result setop.SetOpSource, err error) {
+func (self Or) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return planSource(tx, typ, self)
+}
+
+/*
+plan returns a union of the sources of the filters, or only a residual if any of them has to be scanned.
+*/
+func (self Or) plan(tx *TX, typ reflect.Type) (result *setop.SetOpSource, residual QFilter, err error) {
 	op := setop.SetOp{
 		Merge: setop.First,
 		Type:  setop.Union,
 	}
+	all := false
+	for _, filter := range self {
+		var newSource *setop.SetOpSource
+		var newResidual QFilter
+		if newSource, newResidual, err = planFilter(tx, typ, filter); err != nil {
+			return
+		}
+		if newResidual != nil {
+			residual = self
+			return
+		}
+		if newSource == nil {
+			all = true
+			continue
+		}
+		if tx.cardinality(*newSource) > 0 {
+			op.Sources = append(op.Sources, *newSource)
+		}
+	}
+	if !all && len(op.Sources) == 0 {
+		result = &emptySource
+		return
+	}
+	if !all {
+		result = &setop.SetOpSource{
+			SetOp: &op,
+		}
+	}
+	return
+}
+
+func (self Or) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
 	for _, filter := range self {
-		var newSource setop.SetOpSource
-		if newSource, err = filter.source(typ); err != nil {
+		if result, err = filter.match(tx, typ, value); err != nil || result {
 			return
 		}
-		op.Sources = append(op.Sources, newSource)
 	}
-	result.SetOp = &op
 	return
 }
 
-func (self Or) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
-	for _, filter := range self {
-		if result, err = filter.match(tx, typ, value); err != nil || result {
-			return
-		}
+/*
+And is a QFilter that defines an AND operation.
+*/
+type And []QFilter
+
+func (self And) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return planSource(tx, typ, self)
+}
+
+/*
+plan returns an intersection of the sources of the filters that can use indexes, and a residual of the ones that have to be scanned.
+*/
+func (self And) plan(tx *TX, typ reflect.Type) (result *setop.SetOpSource, residual QFilter, err error) {
+	op := setop.SetOp{
+		Merge: setop.First,
+		Type:  setop.Intersection,
+	}
+	composite, rest, found, err := compositeSource(tx, typ, self)
+	if err != nil {
+		return
+	}
+	if found {
+		op.Sources = append(op.Sources, composite)
+	}
+	// Negated filters are subtracted from the intersection of the others, instead of intersected with their complements.
+	var negated []setop.SetOpSource
+	var residuals And
+	for _, filter := range rest {
+		var newSource *setop.SetOpSource
+		var newResidual QFilter
+		if not, ok := filter.(Not); ok {
+			if newSource, newResidual, err = planFilter(tx, typ, not.Filter); err != nil {
+				return
+			}
+			if newResidual != nil {
+				residuals = append(residuals, not)
+			} else if newSource == nil {
+				negated = append(negated, primarySource(typ))
+			} else {
+				negated = append(negated, *newSource)
+			}
+			continue
+		}
+		if newSource, newResidual, err = planFilter(tx, typ, filter); err != nil {
+			return
+		}
+		if newResidual != nil {
+			residuals = append(residuals, newResidual)
+		}
+		if newSource != nil {
+			op.Sources = append(op.Sources, *newSource)
+		}
+	}
+	// Intersections are faster the smaller their first sources are, and empty if any source is.
+	if tx.orderSources(op.Sources) {
+		result = &emptySource
+		return
+	}
+	switch len(residuals) {
+	case 0:
+	case 1:
+		residual = residuals[0]
+	default:
+		residual = residuals
+	}
+	if len(op.Sources) == 0 && len(negated) == 0 {
+		return
+	}
+	if len(op.Sources) == 0 {
+		op.Sources = append(op.Sources, primarySource(typ))
+	}
+	if len(negated) > 0 {
+		intersection := op
+		op = setop.SetOp{
+			Merge: setop.First,
+			Type:  setop.Difference,
+			Sources: append([]setop.SetOpSource{
+				setop.SetOpSource{
+					SetOp: &intersection,
+				},
+			}, negated...),
+		}
+	}
+	result = &setop.SetOpSource{
+		SetOp: &op,
+	}
+	return
+}
+
+func (self And) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	result, err = true, nil
+	for _, filter := range self {
+		if result, err = filter.match(tx, typ, value); err != nil || !result {
+			return
+		}
+	}
+	return
+}
+
+/*
+Not is a QFilter that defines a NOT operation.
+*/
+type Not struct {
+	Filter QFilter
+}
+
+func (self Not) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return planSource(tx, typ, self)
+}
+
+/*
+plan returns the difference between all objects of typ and the source of the filter, or only a residual if the filter has to be scanned.
+*/
+func (self Not) plan(tx *TX, typ reflect.Type) (result *setop.SetOpSource, residual QFilter, err error) {
+	source, residual, err := planFilter(tx, typ, self.Filter)
+	if err != nil {
+		return
+	}
+	if residual != nil {
+		residual = self
+		return
+	}
+	if source == nil {
+		result = &emptySource
+		return
+	}
+	result = &setop.SetOpSource{
+		SetOp: &setop.SetOp{
+			Sources: []setop.SetOpSource{
+				primarySource(typ),
+				*source,
+			},
+			Merge: setop.First,
+			Type:  setop.Difference,
+		},
+	}
+	return
+}
+
+func (self Not) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	if result, err = self.Filter.match(tx, typ, value); err != nil {
+		return
+	}
+	result = !result
+	return
+}
+
+/*
+primarySource returns a source containing all objects of typ.
+*/
+func primarySource(typ reflect.Type) setop.SetOpSource {
+	return setop.SetOpSource{
+		Key: joinKeys([][]byte{primaryKey, []byte(typ.Name())}),
+	}
+}
+
+/*
+Equals is a QFilter that defines an == operation.
+*/
+type Equals struct {
+	Field string
+	Value interface{}
+}
+
+func (self Equals) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	if !indexed(typ, self.Field) {
+		var found bool
+		if result, _, found, err = compositeSource(tx, typ, []QFilter{self}); err != nil || found {
+			return
+		}
+	}
+	var b []byte
+	if b, err = valueBytes(typ, self.Field, self.Value); err != nil {
+		return
+	}
+	result = setop.SetOpSource{
+		Key: joinKeys([][]byte{[]byte(secondaryIndex), []byte(typ.Name()), []byte(canonicalField(typ, self.Field)), b}),
+	}
+	return
+}
+
+func (self Equals) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	var selfBytes []byte
+	if selfBytes, err = valueBytes(typ, self.Field, self.Value); err != nil {
+		return
+	}
+	var otherBytes [][]byte
+	if otherBytes, err = fieldBytes(value, self.Field); err != nil {
+		return
+	}
+	for _, b := range otherBytes {
+		if bytes.Equal(selfBytes, b) {
+			result = true
+			return
+		}
+	}
+	return
+}
+
+/*
+Contains is a QFilter that matches objects where Value is one of the elements of the slice Field.
+*/
+type Contains struct {
+	Field string
+	Value interface{}
+}
+
+func (self Contains) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return Equals(self).source(tx, typ)
+}
+
+func (self Contains) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return Equals(self).match(tx, typ, value)
+}
+
+/*
+ContainsAll is a QFilter that matches objects where all Values are elements of the slice Field.
+*/
+type ContainsAll struct {
+	Field  string
+	Values []interface{}
+}
+
+func (self ContainsAll) filter() (result And) {
+	for _, value := range self.Values {
+		result = append(result, Contains{self.Field, value})
+	}
+	return
+}
+
+func (self ContainsAll) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	return planSource(tx, typ, self)
+}
+
+func (self ContainsAll) plan(tx *TX, typ reflect.Type) (result *setop.SetOpSource, residual QFilter, err error) {
+	return self.filter().plan(tx, typ)
+}
+
+func (self ContainsAll) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return self.filter().match(tx, typ, value)
+}
+
+/*
+fieldByName returns the field at the possibly dotted path in value.
+*/
+func fieldByName(value reflect.Value, path string) (result reflect.Value, err error) {
+	field, canonical, err := resolveField(value.Type(), path)
+	if err != nil {
+		return
+	}
+	result = fieldValue(value, canonical, field.Type)
+	return
+}
+
+/*
+indexedFieldByName returns the field at the possibly dotted path in value, as it would be indexed.
+*/
+func indexedFieldByName(value reflect.Value, path string) (result reflect.Value, err error) {
+	field, canonical, err := resolveField(value.Type(), path)
+	if err != nil {
+		return
+	}
+	result = indexValue(field, fieldValue(value, canonical, field.Type))
+	return
+}
+
+/*
+HasKey is a QFilter that matches objects where the map Field has Key.
+*/
+type HasKey struct {
+	Field string
+	Key   interface{}
+}
+
+func (self HasKey) prefix(typ reflect.Type) (result []byte, err error) {
+	field, _, err := resolveField(typ, self.Field)
+	if err != nil {
+		return
+	}
+	if !mapped(field.Type) {
+		err = fmt.Errorf("%v.%v is not a map", typ.Name(), self.Field)
+		return
+	}
+	if result, err = fieldValueBytes(field.Type.Key(), reflect.ValueOf(self.Key)); err != nil {
+		return
+	}
+	result = tupleBytes(result)
+	return
+}
+
+func (self HasKey) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	prefix, err := self.prefix(typ)
+	if err != nil {
+		return
+	}
+	return tupleRangeSource(typ, []byte(canonicalField(typ, self.Field)), prefix, valueRange{}), nil
+}
+
+func (self HasKey) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	prefix, err := self.prefix(typ)
+	if err != nil {
+		return
+	}
+	var pairs [][]byte
+	if pairs, err = fieldBytes(value, self.Field); err != nil {
+		return
+	}
+	for _, pair := range pairs {
+		if bytes.HasPrefix(pair, prefix) {
+			result = true
+			return
+		}
+	}
+	return
+}
+
+/*
+KeyEquals is a QFilter that matches objects where the map Field has Value for Key.
+*/
+type KeyEquals struct {
+	Field string
+	Key   interface{}
+	Value interface{}
+}
+
+func (self KeyEquals) pair(typ reflect.Type) (result []byte, err error) {
+	field, _, err := resolveField(typ, self.Field)
+	if err != nil {
+		return
+	}
+	if !mapped(field.Type) {
+		err = fmt.Errorf("%v.%v is not a map", typ.Name(), self.Field)
+		return
+	}
+	return pairBytes(field.Type, reflect.ValueOf(self.Key), reflect.ValueOf(self.Value))
+}
+
+func (self KeyEquals) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	pair, err := self.pair(typ)
+	if err != nil {
+		return
+	}
+	result = setop.SetOpSource{
+		Key: joinKeys([][]byte{secondaryIndex, []byte(typ.Name()), []byte(canonicalField(typ, self.Field)), pair}),
+	}
+	return
+}
+
+func (self KeyEquals) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	pair, err := self.pair(typ)
+	if err != nil {
+		return
+	}
+	var pairs [][]byte
+	if pairs, err = fieldBytes(value, self.Field); err != nil {
+		return
+	}
+	for _, b := range pairs {
+		if bytes.Equal(b, pair) {
+			result = true
+			return
+		}
+	}
+	return
+}
+
+/*
+fieldBytes returns the index bytes of the named field of value, one for each element or key/value pair if the field is multi valued or a map.
+*/
+func fieldBytes(value reflect.Value, name string) (result [][]byte, err error) {
+	field, err := indexedFieldByName(value, name)
+	if err != nil {
+		return
+	}
+	return fieldIndexBytes(field.Type(), field)
+}
+
+/*
+Prefix is a QFilter that matches objects where the string Field, or an element of it if it is a slice, starts with Value.
+*/
+type Prefix struct {
+	Field string
+	Value string
+}
+
+func (self Prefix) prefix(typ reflect.Type) (result []byte, err error) {
+	field, _, err := resolveField(typ, self.Field)
+	if err != nil {
+		return
+	}
+	fieldType := field.Type
+	if multiValued(fieldType) {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType.Kind() == reflect.Ptr {
+		// Non nil pointers are indexed as 1 followed by the index bytes of the value.
+		result = []byte{1}
+		fieldType = fieldType.Elem()
+	}
+	if fieldType.Kind() != reflect.String {
+		err = fmt.Errorf("%v.%v is not a string field", typ.Name(), self.Field)
+		return
+	}
+	value := self.Value
+	if hasParam(field, fold) {
+		value = foldString(value)
+	}
+	result = append(result, value...)
+	return
+}
+
+func (self Prefix) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	prefix, err := self.prefix(typ)
+	if err != nil {
+		return
+	}
+	return valueSpan{
+		bucket: [][]byte{secondaryIndex, []byte(typ.Name()), []byte(canonicalField(typ, self.Field))},
+		prefix: prefix,
+	}.source(), nil
+}
+
+func (self Prefix) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	prefix, err := self.prefix(typ)
+	if err != nil {
+		return
+	}
+	var fieldValues [][]byte
+	if fieldValues, err = fieldBytes(value, self.Field); err != nil {
+		return
+	}
+	for _, b := range fieldValues {
+		if bytes.HasPrefix(b, prefix) {
+			result = true
+			return
+		}
+	}
+	return
+}
+
+/*
+valueRange is a range of index bytes, where a nil min or max means unbounded.
+*/
+type valueRange struct {
+	min    []byte
+	max    []byte
+	minInc bool
+	maxInc bool
+}
+
+/*
+nonNil is the smallest index value of a non nil pointer, since nil pointers are indexed as 0 and non nil pointers as 1 followed by the index bytes of the value.
+*/
+var nonNil = []byte{1}
+
+/*
+withoutNil returns this range with the lower bound raised above nil if field is a pointer, since range filters never match nil pointers.
+*/
+func (self valueRange) withoutNil(typ reflect.Type, field string) valueRange {
+	f, _, err := resolveField(typ, field)
+	if err != nil {
+		return self
+	}
+	fieldType := f.Type
+	if multiValued(fieldType) {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType.Kind() == reflect.Ptr && bytes.Compare(self.min, nonNil) < 0 {
+		self.min, self.minInc = nonNil, true
+	}
+	return self
+}
+
+func (self valueRange) aboveMin(b []byte) bool {
+	if self.min == nil {
+		return true
+	}
+	cmp := bytes.Compare(b, self.min)
+	return cmp > 0 || (cmp == 0 && self.minInc)
+}
+
+func (self valueRange) belowMax(b []byte) bool {
+	if self.max == nil {
+		return true
+	}
+	cmp := bytes.Compare(b, self.max)
+	return cmp < 0 || (cmp == 0 && self.maxInc)
+}
+
+/*
+source returns a span of all index value buckets of field within the range.
+*/
+func (self valueRange) source(typ reflect.Type, field string) setop.SetOpSource {
+	return valueSpan{
+		bucket: [][]byte{secondaryIndex, []byte(typ.Name()), []byte(canonicalField(typ, field))},
+		r:      self,
+	}.source()
+}
+
+func (self valueRange) match(typ reflect.Type, value reflect.Value, fieldName string) (result bool, err error) {
+	var fieldValues [][]byte
+	if fieldValues, err = fieldBytes(value, fieldName); err != nil {
+		return
+	}
+	for _, b := range fieldValues {
+		if self.aboveMin(b) && self.belowMax(b) {
+			result = true
+			return
+		}
+	}
+	return
+}
+
+/*
+rangeFilter is a QFilter matching a range of values of a field.
+Range filters never match nil pointers, so for example Less{"PointerField", 5} only matches non nil values below 5.
+*/
+type rangeFilter interface {
+	QFilter
+	rangeField() string
+	valueRange(typ reflect.Type) (result valueRange, err error)
+}
+
+/*
+Greater is a QFilter that defines a > operation.
+*/
+type Greater struct {
+	Field string
+	Value interface{}
+}
+
+func (self Greater) rangeField() string {
+	return self.Field
+}
+
+func (self Greater) valueRange(typ reflect.Type) (result valueRange, err error) {
+	result.min, result.minInc, err = boundBytes(typ, self.Field, self.Value, true, false)
+	result = result.withoutNil(typ, self.Field)
+	return
+}
+
+func (self Greater) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
+		return
 	}
-	return
+	return r.source(typ, self.Field), nil
+}
+
+func (self Greater) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
+		return
+	}
+	return r.match(typ, value, self.Field)
 }
 
 /*
-And is a QFilter that defines an AND operation.
+GreaterOrEqual is a QFilter that defines a >= operation.
 */
-type And []QFilter
+type GreaterOrEqual struct {
+	Field string
+	Value interface{}
+}
 
-func (self And) source(typ reflect.Type) (result setop.SetOpSource, err error) {
-	op := setop.SetOp{
-		Merge: setop.First,
-		Type:  setop.Intersection,
+func (self GreaterOrEqual) rangeField() string {
+	return self.Field
+}
+
+func (self GreaterOrEqual) valueRange(typ reflect.Type) (result valueRange, err error) {
+	result.min, result.minInc, err = boundBytes(typ, self.Field, self.Value, true, true)
+	result = result.withoutNil(typ, self.Field)
+	return
+}
+
+func (self GreaterOrEqual) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
+		return
 	}
-	for _, filter := range self {
-		var newSource setop.SetOpSource
-		if newSource, err = filter.source(typ); err != nil {
-			return
-		}
-		op.Sources = append(op.Sources, newSource)
+	return r.source(typ, self.Field), nil
+}
+
+func (self GreaterOrEqual) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
+		return
 	}
-	result.SetOp = &op
+	return r.match(typ, value, self.Field)
+}
+
+/*
+Less is a QFilter that defines a < operation.
+Nil pointers never match.
+*/
+type Less struct {
+	Field string
+	Value interface{}
+}
+
+func (self Less) rangeField() string {
+	return self.Field
+}
+
+func (self Less) valueRange(typ reflect.Type) (result valueRange, err error) {
+	result.max, result.maxInc, err = boundBytes(typ, self.Field, self.Value, false, false)
+	result = result.withoutNil(typ, self.Field)
 	return
 }
 
-func (self And) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
-	result, err = true, nil
-	for _, filter := range self {
-		if result, err = filter.match(tx, typ, value); err != nil || !result {
-			return
-		}
+func (self Less) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
+		return
 	}
-	return
+	return r.source(typ, self.Field), nil
+}
+
+func (self Less) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
+		return
+	}
+	return r.match(typ, value, self.Field)
 }
 
 /*
-Equals is a QFilter that defines an == operation.
+LessOrEqual is a QFilter that defines a <= operation.
+Nil pointers never match.
 */
-type Equals struct {
+type LessOrEqual struct {
 	Field string
 	Value interface{}
 }
 
-func (self Equals) source(typ reflect.Type) (result setop.SetOpSource, err error) {
-	value := reflect.ValueOf(self.Value)
-	var b []byte
-	if b, err = indexBytes(value.Type(), value); err != nil {
+func (self LessOrEqual) rangeField() string {
+	return self.Field
+}
+
+func (self LessOrEqual) valueRange(typ reflect.Type) (result valueRange, err error) {
+	result.max, result.maxInc, err = boundBytes(typ, self.Field, self.Value, false, true)
+	result = result.withoutNil(typ, self.Field)
+	return
+}
+
+func (self LessOrEqual) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
 		return
 	}
-	result = setop.SetOpSource{
-		Key: joinKeys([][]byte{[]byte(secondaryIndex), []byte(typ.Name()), []byte(self.Field), b}),
+	return r.source(typ, self.Field), nil
+}
+
+func (self LessOrEqual) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
+		return
+	}
+	return r.match(typ, value, self.Field)
+}
+
+/*
+Between is a QFilter that defines a Min <= x <= Max operation.
+Nil pointers never match.
+*/
+type Between struct {
+	Field string
+	Min   interface{}
+	Max   interface{}
+}
+
+func (self Between) rangeField() string {
+	return self.Field
+}
+
+func (self Between) valueRange(typ reflect.Type) (result valueRange, err error) {
+	if result.min, result.minInc, err = boundBytes(typ, self.Field, self.Min, true, true); err != nil {
+		return
 	}
+	result.max, result.maxInc, err = boundBytes(typ, self.Field, self.Max, false, true)
+	result = result.withoutNil(typ, self.Field)
 	return
 }
 
-func (self Equals) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
-	selfValue := reflect.ValueOf(self.Value)
-	bothType := selfValue.Type()
-	var selfBytes []byte
-	if selfBytes, err = indexBytes(bothType, selfValue); err != nil {
+func (self Between) source(tx *TX, typ reflect.Type) (result setop.SetOpSource, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
 		return
 	}
-	var otherBytes []byte
-	if otherBytes, err = indexBytes(bothType, value.FieldByName(self.Field)); err != nil {
+	return r.source(typ, self.Field), nil
+}
+
+func (self Between) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	r, err := self.valueRange(typ)
+	if err != nil {
 		return
 	}
-	result = bytes.Compare(selfBytes, otherBytes) == 0
-	return
+	return r.match(typ, value, self.Field)
 }
 
 /*
@@ -124,7 +786,13 @@ type Query struct {
 	intersection QFilter
 	difference   QFilter
 	limit        int
+	orders       []order
+	after        string
+	rank         bool
+	strict       bool
+	selected     []string
 	run          func(func(*TX) error) error
+	update       func(func(*TX) error) error
 }
 
 /*
@@ -149,8 +817,16 @@ func (self *Query) Subscription(name string, obj interface{}, ops Operation, sub
 }
 
 type queryRun struct {
-	query *Query
-	tx    *TX
+	query     *Query
+	tx        *TX
+	after     [][]byte
+	afterKV   *orderedKV
+	unordered bool
+	residual  QFilter
+	examined  map[string]int
+	elapsed   map[string]time.Duration
+	walked    map[string]int
+	fields    []string
 }
 
 func (self *Query) match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
@@ -164,7 +840,7 @@ func (self *Query) match(tx *TX, typ reflect.Type, value reflect.Value) (result
 	}
 	if self.difference != nil {
 		if result, err = self.difference.match(tx, typ, value); err != nil || result {
-			result = true
+			result = false
 			return
 		}
 	}
@@ -172,61 +848,160 @@ func (self *Query) match(tx *TX, typ reflect.Type, value reflect.Value) (result
 	return
 }
 
-func (self *queryRun) each(f func(elementPointer reflect.Value) (bool, error)) (err error) {
-	op := &setop.SetOp{
+/*
+op returns the set operation for the parts of the query that can use indexes, and sets the residual filter that its results have to be matched against.
+*/
+func (self *queryRun) op() (op *setop.SetOp, err error) {
+	// Each plan caches the cardinalities of its own sources, so that the cache doesn't grow with the number of queries run in a transaction.
+	self.tx.planned = nil
+	op = &setop.SetOp{
 		Sources: []setop.SetOpSource{
-			setop.SetOpSource{
-				Key: joinKeys([][]byte{[]byte(primaryKey), []byte(self.query.typ.Name())}),
-			},
+			primarySource(self.query.typ),
 		},
 		Type:  setop.Intersection,
 		Merge: setop.First,
 	}
+	var residuals And
 	if self.query.intersection != nil {
-		source, err := self.query.intersection.source(self.query.typ)
-		if err != nil {
-			return err
+		var source *setop.SetOpSource
+		var residual QFilter
+		if source, residual, err = planFilter(self.tx, self.query.typ, self.query.intersection); err != nil {
+			return
+		}
+		if source != nil {
+			op.Sources = append(op.Sources, *source)
+		}
+		if residual != nil {
+			residuals = append(residuals, residual)
 		}
-		op.Sources = append(op.Sources, source)
 	}
 	if self.query.difference != nil {
-		var source setop.SetOpSource
-		if source, err = self.query.difference.source(self.query.typ); err != nil {
+		var source *setop.SetOpSource
+		var residual QFilter
+		if source, residual, err = planFilter(self.tx, self.query.typ, self.query.difference); err != nil {
 			return
 		}
-		op = &setop.SetOp{
-			Sources: []setop.SetOpSource{
-				setop.SetOpSource{
-					SetOp: op,
-				},
-				source,
-			},
-			Type:  setop.Difference,
-			Merge: setop.First,
+		if residual != nil {
+			residuals = append(residuals, Not{self.query.difference})
+		} else {
+			if source == nil {
+				op.Sources = append(op.Sources, emptySource)
+			} else {
+				op = &setop.SetOp{
+					Sources: []setop.SetOpSource{
+						setop.SetOpSource{
+							SetOp: op,
+						},
+						*source,
+					},
+					Type:  setop.Difference,
+					Merge: setop.First,
+				}
+			}
 		}
 	}
-	limit := self.query.limit
-	for _, kv := range self.tx.setOp(&setop.SetExpression{
+	switch len(residuals) {
+	case 0:
+	case 1:
+		self.residual = residuals[0]
+	default:
+		self.residual = residuals
+	}
+	if self.residual != nil && self.query.strict {
+		err = ErrNotIndexed{
+			Type:   self.query.typ.Name(),
+			Filter: self.residual,
+		}
+	}
+	return
+}
+
+/*
+skipper creates skippers like TX.skipper, but makes the primary key skipper start after the Id in the token of the query.
+*/
+func (self *queryRun) skipper(b []byte) (result setop.Skipper, err error) {
+	if result, err = self.tx.skipper(b); err != nil {
+		return
+	}
+	if self.after != nil && bytes.Equal(b, primarySource(self.query.typ).Key) {
+		result.(*skipper).after = self.after[len(self.after)-1]
+	}
+	result = self.counted(b, result)
+	return
+}
+
+/*
+token returns a token that, given to After, will make the query continue after value.
+*/
+func (self *queryRun) token(value reflect.Value) (result string, err error) {
+	keys, err := self.orderBytes(value, self.query.orders)
+	if err != nil {
+		return
+	}
+	keys = append(keys, value.FieldByName(idField).Bytes())
+	result = base64.URLEncoding.EncodeToString(joinKeys(keys))
+	return
+}
+
+func (self *queryRun) parseToken() (err error) {
+	if self.query.after == "" {
+		return
+	}
+	b, err := base64.URLEncoding.DecodeString(self.query.after)
+	if err != nil {
+		return
+	}
+	keys := splitKeys(b)
+	if len(keys) != len(self.query.orders)+1 {
+		return fmt.Errorf("%v is not a valid token for this query", self.query.after)
+	}
+	self.after = keys
+	return
+}
+
+func (self *queryRun) eachKV(f func(kv kv) (bool, error)) (err error) {
+	if err = self.parseToken(); err != nil {
+		return
+	}
+	op, err := self.op()
+	if err != nil {
+		return
+	}
+	if self.residual != nil {
+		f = self.residualMatcher(self.residual, f)
+	}
+	if self.query.rank && !self.unordered {
+		return self.eachRanked(op, f)
+	}
+	if len(self.query.orders) > 0 && !self.unordered {
+		return self.eachOrdered(op, f)
+	}
+	return self.tx.setOp(&setop.SetExpression{
 		Op: op,
-	}) {
-		obj := reflect.New(self.query.typ).Interface()
-		if err = json.Unmarshal(kv.Value, obj); err != nil {
+	}, self.skipper, f)
+}
+
+func (self *queryRun) each(f func(elementPointer reflect.Value) (bool, error)) (err error) {
+	limit := self.query.limit
+	load, err := self.loader()
+	if err != nil {
+		return
+	}
+	return self.eachKV(func(kv kv) (cont bool, err error) {
+		var obj reflect.Value
+		if obj, err = load(kv); err != nil {
 			return
 		}
-		cont := false
-		if cont, err = f(reflect.ValueOf(obj)); err != nil {
+		if cont, err = f(obj); err != nil || !cont {
 			return
 		}
-		if !cont {
-			break
-		}
 		if limit == 1 {
-			break
+			cont = false
 		} else if limit > 1 {
 			limit--
 		}
-	}
-	return
+		return
+	})
 }
 
 /*
@@ -245,14 +1020,113 @@ func (self *Query) Limit(l int) *Query {
 	return self
 }
 
+/*
+OrderBy will sort the results of this query by the indexed field in the given direction.
+Calling it several times will break ties in the earlier fields with the later ones, and remaining ties are broken by Id.
+*/
+func (self *Query) OrderBy(field string, dir Direction) *Query {
+	self.orders = append(self.orders, order{
+		field:     field,
+		direction: dir,
+	})
+	return self
+}
+
+/*
+Rank will sort the results of this query by the number of times the terms of the Match filters in it occur in their fields, with ties broken by Id.
+Ranked queries load all results before sorting them, and can't be ordered by fields or paged.
+*/
+func (self *Query) Rank() *Query {
+	self.rank = true
+	return self
+}
+
+/*
+Strict will make this query return an ErrNotIndexed instead of scanning all objects of the type when a filter can't use any index.
+*/
+func (self *Query) Strict() *Query {
+	self.strict = true
+	return self
+}
+
 /*
 Where will add a filter limiting the results of this query to matching items.
+Filters on fields without indexes will be matched against the objects found using the other filters, or against all objects of the type, unless the query is Strict.
 */
 func (self *Query) Where(f QFilter) *Query {
 	self.intersection = f
 	return self
 }
 
+/*
+Each will run f with each result of this query, as a pointer to a new value of the same type as obj, until f returns false or an error.
+The results are streamed from the database, so no more than needed are loaded.
+*/
+func (self *Query) Each(obj interface{}, f func(obj interface{}) (cont bool, err error)) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	return self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+		}
+		return run.each(func(elementPointer reflect.Value) (bool, error) {
+			return f(elementPointer.Interface())
+		})
+	})
+}
+
+/*
+Count returns the number of objects of the same type as obj matching this query, without loading them.
+*/
+func (self *Query) Count(obj interface{}) (result int, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	err = self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+			// The order doesn't change the count, unless we are continuing after a token.
+			unordered: self.after == "",
+		}
+		return run.eachKV(func(kv kv) (cont bool, err error) {
+			result++
+			cont = self.limit < 1 || result < self.limit
+			return
+		})
+	})
+	return
+}
+
+/*
+Exists returns whether any object of the same type as obj matches this query, without loading it.
+*/
+func (self *Query) Exists(obj interface{}) (result bool, err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	err = self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query:     self,
+			tx:        tx,
+			unordered: self.after == "",
+		}
+		return run.eachKV(func(kv kv) (cont bool, err error) {
+			result = true
+			return
+		})
+	})
+	return
+}
+
 /*
 First will load the first match of this query into result.
 */
@@ -281,43 +1155,109 @@ func (self *Query) First(result interface{}) (found bool, err error) {
 	return
 }
 
-/*
-All will load all results of this quer into result.
-*/
-func (self *Query) All(result interface{}) (err error) {
+func sliceTarget(result interface{}) (sliceValue reflect.Value, elemType reflect.Type, pointerSlice bool, err error) {
 	slicePtrValue := reflect.ValueOf(result)
 	if slicePtrValue.Kind() != reflect.Ptr {
 		err = fmt.Errorf("%v is not a pointer", result)
 		return
 	}
-	sliceValue := slicePtrValue.Elem()
+	sliceValue = slicePtrValue.Elem()
 	if sliceValue.Kind() != reflect.Slice {
 		err = fmt.Errorf("%v is not a pointer to a slice", result)
 		return
 	}
-	sliceType := sliceValue.Type()
-	sliceElemType := sliceType.Elem()
-	pointerSlice := false
-	if sliceElemType.Kind() == reflect.Ptr {
+	elemType = sliceValue.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
 		pointerSlice = true
-		sliceElemType = sliceElemType.Elem()
+		elemType = elemType.Elem()
 	}
-	if sliceElemType.Kind() != reflect.Struct {
+	if elemType.Kind() != reflect.Struct {
 		err = fmt.Errorf("%v is not pointer to a slice of structs or structpointers", result)
 		return
 	}
-	self.typ = sliceElemType
+	return
+}
+
+func appendTo(sliceValue reflect.Value, pointerSlice bool, elementPointer reflect.Value) {
+	if pointerSlice {
+		sliceValue.Set(reflect.Append(sliceValue, elementPointer))
+	} else {
+		sliceValue.Set(reflect.Append(sliceValue, elementPointer.Elem()))
+	}
+}
+
+/*
+All will load all results of this quer into result.
+*/
+func (self *Query) All(result interface{}) (err error) {
+	sliceValue, elemType, pointerSlice, err := sliceTarget(result)
+	if err != nil {
+		return
+	}
+	self.typ = elemType
 	if err = self.run(func(tx *TX) (err error) {
 		run := &queryRun{
 			query: self,
 			tx:    tx,
 		}
 		if err = run.each(func(elementPointer reflect.Value) (cont bool, err error) {
-			if pointerSlice {
-				sliceValue.Set(reflect.Append(sliceValue, elementPointer))
-			} else {
-				sliceValue.Set(reflect.Append(sliceValue, elementPointer.Elem()))
+			appendTo(sliceValue, pointerSlice, elementPointer)
+			cont = true
+			return
+		}); err != nil {
+			return
+		}
+		return
+	}); err != nil {
+		return
+	}
+	return
+}
+
+/*
+After will make this query continue after the position encoded in a token returned by Page.
+*/
+func (self *Query) After(token string) *Query {
+	self.after = token
+	return self
+}
+
+/*
+Page will load the results of this query into result, at most Limit of them, starting after the token given to After.
+If there are more results, next will be a token that can be given to After to load the next page.
+*/
+func (self *Query) Page(result interface{}) (next string, err error) {
+	sliceValue, elemType, pointerSlice, err := sliceTarget(result)
+	if err != nil {
+		return
+	}
+	self.typ = elemType
+	if err = self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+		}
+		orders := make([]string, len(self.orders))
+		for index, o := range self.orders {
+			orders[index] = o.field
+		}
+		// The next token needs the fields the results are ordered by.
+		load, err := run.loader(orders...)
+		if err != nil {
+			return
+		}
+		count := 0
+		var last reflect.Value
+		if err = run.eachKV(func(kv kv) (cont bool, err error) {
+			if self.limit > 0 && count == self.limit {
+				next, err = run.token(last.Elem())
+				return
+			}
+			if last, err = load(kv); err != nil {
+				return
 			}
+			appendTo(sliceValue, pointerSlice, last)
+			count++
 			cont = true
 			return
 		}); err != nil {
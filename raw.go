@@ -0,0 +1,82 @@
+package unbolted
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+/*
+Raw is an object as stored in the database, and its Id.
+*/
+type Raw struct {
+	Id    Id
+	Value json.RawMessage
+}
+
+/*
+raw returns a Raw for kv, copying the bytes since they are only valid during the transaction.
+*/
+func raw(kv kv) Raw {
+	return Raw{
+		Id:    Id(append([]byte{}, kv.Keys[0]...)),
+		Value: json.RawMessage(append([]byte{}, kv.Value...)),
+	}
+}
+
+/*
+GetRaw will return the stored bytes of the object in this TX of the same type and id as obj, without decoding them.
+*/
+func (self *TX) GetRaw(obj interface{}) (result json.RawMessage, err error) {
+	value, id, err := identify(obj)
+	if err != nil {
+		return
+	}
+	buckets, err := self.dig([][]byte{primaryKey, []byte(value.Type().Name())}, false)
+	if err != nil {
+		return
+	}
+	b := buckets[len(buckets)-1].Get(id.Bytes())
+	if b == nil {
+		err = ErrNotFound
+		return
+	}
+	result = json.RawMessage(append([]byte{}, b...))
+	return
+}
+
+/*
+EachRaw will run f with the stored bytes of each result of this query for objects of the same type as obj, without decoding them unless a filter can't use indexes, until f returns false or an error.
+*/
+func (self *Query) EachRaw(obj interface{}, f func(raw Raw) (cont bool, err error)) (err error) {
+	var value reflect.Value
+	if value, _, err = identify(obj); err != nil {
+		return
+	}
+	self.typ = value.Type()
+	return self.run(func(tx *TX) (err error) {
+		run := &queryRun{
+			query: self,
+			tx:    tx,
+		}
+		count := 0
+		return run.eachKV(func(kv kv) (cont bool, err error) {
+			if cont, err = f(raw(kv)); err != nil || !cont {
+				return
+			}
+			count++
+			cont = self.limit < 1 || count < self.limit
+			return
+		})
+	})
+}
+
+/*
+AllRaw will return the stored bytes of all results of this query for objects of the same type as obj.
+*/
+func (self *Query) AllRaw(obj interface{}) (result []Raw, err error) {
+	err = self.EachRaw(obj, func(raw Raw) (bool, error) {
+		result = append(result, raw)
+		return true, nil
+	})
+	return
+}
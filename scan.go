@@ -0,0 +1,127 @@
+package unbolted
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/zond/setop"
+)
+
+/*
+ErrNotIndexed is returned by strict queries, and by filters that have to produce a source, when a filter can't be served by any index.
+*/
+type ErrNotIndexed struct {
+	Type   string
+	Filter QFilter
+}
+
+func (self ErrNotIndexed) Error() string {
+	return fmt.Sprintf("%+v can't use any index of %v, and would have to scan all of them", self.Filter, self.Type)
+}
+
+/*
+planner is implemented by QFilters combining other QFilters, some of which may not be able to use any index.
+*/
+type planner interface {
+	plan(tx *TX, typ reflect.Type) (result *setop.SetOpSource, residual QFilter, err error)
+}
+
+/*
+planFilter returns a source for the parts of filter that can use indexes, and a residual filter that results from it have to be matched against.
+A nil result means all objects of typ, and a nil residual means that all objects from the result match.
+*/
+func planFilter(tx *TX, typ reflect.Type, filter QFilter) (result *setop.SetOpSource, residual QFilter, err error) {
+	if p, ok := filter.(planner); ok {
+		return p.plan(tx, typ)
+	}
+	if !indexable(typ, filter) {
+		residual = filter
+		return
+	}
+	source, err := filter.source(tx, typ)
+	if err != nil {
+		return
+	}
+	result = &source
+	return
+}
+
+/*
+planSource returns a source for filter, or an ErrNotIndexed if parts of it can't use any index.
+*/
+func planSource(tx *TX, typ reflect.Type, filter QFilter) (result setop.SetOpSource, err error) {
+	source, residual, err := planFilter(tx, typ, filter)
+	if err != nil {
+		return
+	}
+	if residual != nil {
+		err = ErrNotIndexed{
+			Type:   typ.Name(),
+			Filter: residual,
+		}
+		return
+	}
+	if source == nil {
+		result = primarySource(typ)
+		return
+	}
+	result = *source
+	return
+}
+
+/*
+indexable returns whether filter, which is not a planner, can use an index of typ.
+*/
+func indexable(typ reflect.Type, filter QFilter) bool {
+	switch f := filter.(type) {
+	case Equals:
+		return indexed(typ, f.Field) || leadsComposite(typ, f.Field)
+	case Contains:
+		return indexed(typ, f.Field) || leadsComposite(typ, f.Field)
+	case Prefix:
+		return indexed(typ, f.Field)
+	case HasKey:
+		return indexed(typ, f.Field)
+	case KeyEquals:
+		return indexed(typ, f.Field)
+	case rangeFilter:
+		return indexed(typ, f.rangeField())
+	}
+	return true
+}
+
+/*
+leadsComposite returns whether the field at path in typ is the first field of a composite index.
+*/
+func leadsComposite(typ reflect.Type, path string) bool {
+	canonical := canonicalField(typ, path)
+	for _, composite := range compositeIndexes(typ) {
+		if composite.fields[0].path == canonical {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+residualMatcher returns a function running f only with the values matching residual.
+*/
+func (self *queryRun) residualMatcher(residual QFilter, f func(kv kv) (bool, error)) func(kv kv) (bool, error) {
+	return func(kv kv) (cont bool, err error) {
+		value := reflect.New(self.query.typ)
+		if err = json.Unmarshal(kv.Value, value.Interface()); err != nil {
+			return
+		}
+		matched := false
+		if matched, err = residual.match(self.tx, self.query.typ, value.Elem()); err != nil {
+			return
+		}
+		if !matched {
+			cont = true
+			return
+		}
+		kv.decoded = value
+		return f(kv)
+	}
+}
@@ -2,52 +2,81 @@ package unbolted
 
 import (
 	"bytes"
+	"reflect"
 
 	"github.com/boltdb/bolt"
 	"github.com/zond/setop"
 )
 
+/*
+emptySource is a setop source that never yields any results.
+*/
+var emptySource = setop.SetOpSource{
+	Key: joinKeys([][]byte{[]byte("empty")}),
+}
+
+/*
+kv is a result of a set operation.
+ordered is the index value of the first order field if it was found by walking its index,
+and decoded the object Value decodes to, if it was decoded to be matched against a residual filter.
+*/
 type kv struct {
-	Keys  [][]byte
-	Value []byte
+	Keys    [][]byte
+	Value   []byte
+	ordered []byte
+	decoded reflect.Value
 }
 
 type skipper struct {
-	cursor    *bolt.Cursor
-	lastKey   []byte
-	lastValue []byte
+	cursor       *bolt.Cursor
+	after        []byte
+	lastMin      []byte
+	lastMinAfter bool
+	lastKey      []byte
+	lastValue    []byte
+}
+
+/*
+includes returns whether key is at or after min, or after min if after is set.
+*/
+func includes(min []byte, after bool, key []byte) bool {
+	cmp := bytes.Compare(min, key)
+	return cmp < 0 || (cmp == 0 && !after)
 }
 
 // Skip returns a value matching the min and inclusive criteria.
 // If the last yielded value matches the criteria the same value will be returned again.
+// If after is set, only values after it will be returned.
 func (self *skipper) Skip(min []byte, inc bool) (result *setop.SetOpResult, err error) {
 	if self.cursor == nil {
 		return
 	}
+	if self.after != nil && (min == nil || bytes.Compare(min, self.after) < 1) {
+		min, inc = self.after, false
+	}
 	var key []byte
 	var value []byte
 
-	if self.lastKey == nil {
-		if min == nil {
-			key, value = self.cursor.First()
-		} else {
-			key, value = self.cursor.Seek(min)
-		}
+	cmp := bytes.Compare(self.lastMin, min)
+	if self.lastKey != nil && (cmp < 0 || (cmp == 0 && (!self.lastMinAfter || !inc))) && includes(min, !inc, self.lastKey) {
+		// There are no keys between the last min and the last key, so the last key is still the first key matching any min between them.
+		return &setop.SetOpResult{
+			Key:    self.lastKey,
+			Values: [][]byte{self.lastValue},
+		}, nil
+	}
+	// Nested set operations can ask for keys before the last min again, so seek whenever the last key can't be reused.
+	if min == nil {
+		key, value = self.cursor.First()
 	} else {
-		if min == nil {
-			key, value = self.lastKey, self.lastValue
-		} else if bytes.Compare(min, self.lastKey) < 1 {
-			key, value = self.lastKey, self.lastValue
-		} else {
-			key, value = self.cursor.Seek(min)
-		}
+		key, value = self.cursor.Seek(min)
 	}
 
 	if !inc && min != nil && bytes.Compare(min, key) == 0 {
 		key, value = self.cursor.Next()
 	}
 
-	self.lastKey, self.lastValue = key, value
+	self.lastMin, self.lastMinAfter, self.lastKey, self.lastValue = min, !inc && min != nil, key, value
 
 	if key != nil {
 		result = &setop.SetOpResult{
@@ -58,3 +87,18 @@ func (self *skipper) Skip(min []byte, inc bool) (result *setop.SetOpResult, err
 
 	return
 }
+
+/*
+stoppableSkipper stops yielding values when stopped is set, which makes any set operation using it finish.
+*/
+type stoppableSkipper struct {
+	setop.Skipper
+	stopped *bool
+}
+
+func (self *stoppableSkipper) Skip(min []byte, inc bool) (result *setop.SetOpResult, err error) {
+	if *self.stopped {
+		return
+	}
+	return self.Skipper.Skip(min, inc)
+}
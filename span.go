@@ -0,0 +1,297 @@
+package unbolted
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/zond/setop"
+)
+
+/*
+spanKey is the first part of the keys of span sources.
+*/
+var spanKey = []byte("span")
+
+const (
+	spanTuple = 1 << iota
+	spanMin
+	spanMinInc
+	spanMax
+	spanMaxInc
+)
+
+/*
+valueSpan is the value buckets of the index bucket named by bucket whose keys start with prefix, and continue with a part within r.
+If tuple is set, the part is the tuple part following the prefix, as in composite and map indexes, otherwise it is the rest of the key.
+
+A span is used as a single source, whose skipper merges the cursors of all value buckets in it,
+which is much cheaper than a union with one source for each value when the values are many, like for time stamps.
+*/
+type valueSpan struct {
+	bucket [][]byte
+	prefix []byte
+	tuple  bool
+	r      valueRange
+}
+
+/*
+source returns the source reading the objects in this span.
+*/
+func (self valueSpan) source() setop.SetOpSource {
+	flags := 0
+	if self.tuple {
+		flags |= spanTuple
+	}
+	if self.r.min != nil {
+		flags |= spanMin
+	}
+	if self.r.minInc {
+		flags |= spanMinInc
+	}
+	if self.r.max != nil {
+		flags |= spanMax
+	}
+	if self.r.maxInc {
+		flags |= spanMaxInc
+	}
+	keys := append([][]byte{spanKey}, self.bucket...)
+	return setop.SetOpSource{
+		Key: joinKeys(append(keys, self.prefix, []byte{byte(flags)}, self.r.min, self.r.max)),
+	}
+}
+
+/*
+parseSpan returns the span a source key was created from, or false if it is not a span source key.
+*/
+func parseSpan(key []byte) (result valueSpan, ok bool) {
+	if !bytes.HasPrefix(key, joinKeys([][]byte{spanKey})) {
+		return
+	}
+	keys := splitKeys(key)
+	if len(keys) != 8 || len(keys[5]) != 1 {
+		return
+	}
+	flags := keys[5][0]
+	result = valueSpan{
+		bucket: keys[1:4],
+		prefix: keys[4],
+		tuple:  flags&spanTuple != 0,
+		r: valueRange{
+			minInc: flags&spanMinInc != 0,
+			maxInc: flags&spanMaxInc != 0,
+		},
+	}
+	if flags&spanMin != 0 {
+		result.r.min = append([]byte{}, keys[6]...)
+	}
+	if flags&spanMax != 0 {
+		result.r.max = append([]byte{}, keys[7]...)
+	}
+	ok = true
+	return
+}
+
+func (self valueSpan) String() string {
+	names := make([]string, len(self.bucket))
+	for index, name := range self.bucket {
+		names[index] = string(name)
+	}
+	result := strings.Join(names, "/")
+	if len(self.prefix) > 0 {
+		result += fmt.Sprintf("/%q", self.prefix)
+	}
+	if self.r.min == nil && self.r.max == nil {
+		return result + "/*"
+	}
+	open, close := "(", ")"
+	if self.r.minInc {
+		open = "["
+	}
+	if self.r.maxInc {
+		close = "]"
+	}
+	min, max := "", ""
+	if self.r.min != nil {
+		min = fmt.Sprintf("%q", self.r.min)
+	}
+	if self.r.max != nil {
+		max = fmt.Sprintf("%q", self.r.max)
+	}
+	return fmt.Sprintf("%v%v%v, %v%v", result, open, min, max, close)
+}
+
+/*
+each runs f with the key and bucket of each value bucket in this span, in key order, until f returns false or an error.
+*/
+func (self valueSpan) each(tx *TX, f func(key []byte, bucket *bolt.Bucket) (bool, error)) (err error) {
+	buckets, err := tx.dig(self.bucket, false)
+	if err != nil {
+		if err == ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	start := self.prefix
+	if self.r.min != nil {
+		start = append([]byte{}, self.prefix...)
+		if self.tuple {
+			start = append(start, tupleBytes(self.r.min)...)
+		} else {
+			start = append(start, self.r.min...)
+		}
+	}
+	cursor := buckets[len(buckets)-1].Cursor()
+	for key, _ := cursor.Seek(start); key != nil && bytes.HasPrefix(key, self.prefix); key, _ = cursor.Next() {
+		part := key[len(self.prefix):]
+		if self.tuple {
+			part, _ = tuplePart(part)
+		}
+		if !self.r.belowMax(part) {
+			break
+		}
+		if !self.r.aboveMin(part) {
+			continue
+		}
+		bucket := buckets[len(buckets)-1].Bucket(key)
+		if bucket == nil {
+			continue
+		}
+		cont := false
+		if cont, err = f(key, bucket); err != nil || !cont {
+			return
+		}
+	}
+	return
+}
+
+/*
+skipper returns a skipper yielding the Ids in all value buckets of this span, in order.
+*/
+func (self valueSpan) skipper(tx *TX) (result *spanSkipper, err error) {
+	result = &spanSkipper{}
+	err = self.each(tx, func(key []byte, bucket *bolt.Bucket) (bool, error) {
+		result.cursors = append(result.cursors, &spanCursor{
+			cursor: bucket.Cursor(),
+		})
+		return true, nil
+	})
+	return
+}
+
+/*
+spanProbe is the number of value buckets of a span whose counts are read to estimate its cardinality.
+Spans can contain a value bucket for each object, like for time stamps, so reading all their counts could take longer than running the query.
+*/
+const spanProbe = 32
+
+/*
+cardinality returns the number of Ids in all value buckets of this span, or unknownCardinality if it has more than spanProbe value buckets.
+*/
+func (self valueSpan) cardinality(tx *TX) (result int) {
+	probed := 0
+	if err := self.each(tx, func(key []byte, bucket *bolt.Bucket) (bool, error) {
+		if probed++; probed > spanProbe {
+			result = unknownCardinality
+			return false, nil
+		}
+		result += tx.bucketCardinality(joinKeys(append(append([][]byte{}, self.bucket...), key)))
+		return result < unknownCardinality, nil
+	}); err != nil || result > unknownCardinality {
+		return unknownCardinality
+	}
+	return
+}
+
+type spanCursor struct {
+	cursor *bolt.Cursor
+	key    []byte
+	value  []byte
+}
+
+/*
+spanCursors is a heap of cursors ordered by their current keys.
+*/
+type spanCursors []*spanCursor
+
+func (self spanCursors) Len() int {
+	return len(self)
+}
+
+func (self spanCursors) Less(i, j int) bool {
+	return bytes.Compare(self[i].key, self[j].key) < 0
+}
+
+func (self spanCursors) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self *spanCursors) Push(x interface{}) {
+	*self = append(*self, x.(*spanCursor))
+}
+
+func (self *spanCursors) Pop() (result interface{}) {
+	result = (*self)[len(*self)-1]
+	*self = (*self)[:len(*self)-1]
+	return
+}
+
+/*
+spanSkipper merges the cursors of the value buckets of a span, keeping the ones that aren't exhausted in a heap ordered by their current keys.
+*/
+type spanSkipper struct {
+	cursors      []*spanCursor
+	active       spanCursors
+	started      bool
+	lastMin      []byte
+	lastMinAfter bool
+}
+
+/*
+seek moves cursor to the first key matching min and inc.
+*/
+func (self *spanCursor) seek(min []byte, inc bool) {
+	if min == nil {
+		self.key, self.value = self.cursor.First()
+	} else {
+		self.key, self.value = self.cursor.Seek(min)
+	}
+	if !inc && min != nil && bytes.Equal(min, self.key) {
+		self.key, self.value = self.cursor.Next()
+	}
+}
+
+func (self *spanSkipper) Skip(min []byte, inc bool) (result *setop.SetOpResult, err error) {
+	after := !inc && min != nil
+	cmp := bytes.Compare(min, self.lastMin)
+	if !self.started || cmp < 0 || (cmp == 0 && !after && self.lastMinAfter) {
+		// Nested set operations can ask for keys before the last min again, which needs all cursors to seek.
+		self.active = self.active[:0]
+		for _, cursor := range self.cursors {
+			if cursor.seek(min, inc); cursor.key != nil {
+				self.active = append(self.active, cursor)
+			}
+		}
+		heap.Init(&self.active)
+		self.started = true
+	} else {
+		// Only the cursors behind min have to move.
+		for len(self.active) > 0 && !includes(min, after, self.active[0].key) {
+			if self.active[0].seek(min, inc); self.active[0].key == nil {
+				heap.Pop(&self.active)
+			} else {
+				heap.Fix(&self.active, 0)
+			}
+		}
+	}
+	self.lastMin, self.lastMinAfter = min, after
+	if len(self.active) > 0 {
+		result = &setop.SetOpResult{
+			Key:    self.active[0].key,
+			Values: [][]byte{self.active[0].value},
+		}
+	}
+	return
+}
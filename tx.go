@@ -1,6 +1,7 @@
 package unbolted
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -11,8 +12,10 @@ import (
 )
 
 type TX struct {
-	tx *bolt.Tx
-	db *DB
+	tx            *bolt.Tx
+	db            *DB
+	formatChecked bool
+	planned       *cardinalities
 }
 
 /*
@@ -26,6 +29,9 @@ func (self *TX) update(id []byte, oldValue, objValue reflect.Value, typ reflect.
 	if updatedAt := objValue.FieldByName(updatedAtField); updatedAt.IsValid() && updatedAt.Type() == timeType {
 		updatedAt.Set(reflect.ValueOf(time.Now()))
 	}
+	if err = self.checkUnique(id, objValue, typ); err != nil {
+		return
+	}
 	if err = self.deIndex(id, oldValue, typ); err != nil {
 		return
 	}
@@ -62,8 +68,11 @@ func (self *TX) create(id []byte, value reflect.Value, typ reflect.Type, obj int
 	if createdAt := value.FieldByName(createdAtField); createdAt.IsValid() && createdAt.Type() == timeType {
 		createdAt.Set(reflect.ValueOf(time.Now()))
 	}
-	if err := self.index(id, value, typ); err != nil {
-		return err
+	if err = self.checkUnique(id, value, typ); err != nil {
+		return
+	}
+	if err = self.index(id, value, typ); err != nil {
+		return
 	}
 	if err = self.save(id, typ, obj); err != nil {
 		return
@@ -96,6 +105,11 @@ func (self *TX) Count(obj interface{}) (result int, err error) {
 }
 
 func (self *TX) dig(keys [][]byte, create bool) (buckets []*bolt.Bucket, err error) {
+	if bytes.Equal(keys[0], secondaryIndex) {
+		if err = self.checkFormat(create); err != nil {
+			return
+		}
+	}
 	var bucket *bolt.Bucket
 	if create {
 		if bucket, err = self.tx.CreateBucketIfNotExists(keys[0]); err != nil {
@@ -143,50 +157,144 @@ func (self *TX) Index(obj interface{}) (err error) {
 	if err = self.get(idBytes, oldValue, old); err != nil {
 		return
 	}
+	if err = self.checkUnique(idBytes, value, value.Type()); err != nil {
+		return
+	}
 	if err = self.deIndex(idBytes, oldValue, oldValue.Type()); err != nil {
 		return
 	}
 	return self.index(idBytes, value, value.Type())
 }
 
+/*
+checkUnique returns an ErrUniqueViolation if any object of typ other than id has the same value as value in any field annotated with `unbolted:"unique"`.
+Nil pointers are not checked.
+*/
+func (self *TX) checkUnique(id []byte, value reflect.Value, typ reflect.Type) (err error) {
+	for _, field := range indexedFields(typ) {
+		if !hasParam(field.field, unique) {
+			continue
+		}
+		fieldValue := fieldValue(value, field.path, field.field.Type)
+		if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+			// Nil means there is no value, so any number of objects can have it.
+			continue
+		}
+		var indexed [][][]byte
+		if indexed, err = indexKey(id, typ, field.path, field.field.Type, indexValue(field.field, fieldValue)); err != nil {
+			return
+		}
+		for _, keys := range indexed {
+			var buckets []*bolt.Bucket
+			if buckets, err = self.dig(keys[:len(keys)-1], false); err != nil {
+				if err == ErrNotFound {
+					err = nil
+					continue
+				}
+				return
+			}
+			cursor := buckets[len(buckets)-1].Cursor()
+			for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+				if !bytes.Equal(key, id) {
+					violation := ErrUniqueViolation{
+						Type:  typ.Name(),
+						Field: field.path,
+					}
+					if fieldValue.CanInterface() {
+						violation.Value = fieldValue.Interface()
+					}
+					return violation
+				}
+			}
+		}
+	}
+	return
+}
+
 func (self *TX) index(id []byte, value reflect.Value, typ reflect.Type) (err error) {
 	var indexed [][][]byte
 	if indexed, err = indexKeys(id, value, typ); err != nil {
 		return
 	}
 	for _, keys := range indexed {
-		var buckets []*bolt.Bucket
-		if buckets, err = self.dig(keys[:len(keys)-1], true); err != nil {
+		if err = self.putIndex(keys, []byte{0}); err != nil {
 			return
 		}
-		if err = buckets[len(buckets)-1].Put(keys[len(keys)-1], []byte{0}); err != nil {
+	}
+	var postings [][][]byte
+	var frequencies [][]byte
+	if postings, frequencies, err = fulltextKeys(id, value, typ); err != nil {
+		return
+	}
+	for index, keys := range postings {
+		if err = self.putIndex(keys, frequencies[index]); err != nil {
 			return
 		}
 	}
 	return
 }
 
+/*
+putIndex puts value under the last of keys, in the bucket found by digging through the rest of them, and counts it if it is new.
+*/
+func (self *TX) putIndex(keys [][]byte, value []byte) (err error) {
+	buckets, err := self.dig(keys[:len(keys)-1], true)
+	if err != nil {
+		return
+	}
+	bucket := buckets[len(buckets)-1]
+	existed := bucket.Get(keys[len(keys)-1]) != nil
+	if err = bucket.Put(keys[len(keys)-1], value); err != nil {
+		return
+	}
+	if !existed {
+		err = self.count(keys[:len(keys)-1], bucket, 1)
+	}
+	return
+}
+
 func (self *TX) deIndex(id []byte, value reflect.Value, typ reflect.Type) (err error) {
 	var indexed [][][]byte
 	if indexed, err = indexKeys(id, value, typ); err != nil {
 		return
 	}
-	for _, keys := range indexed {
-		var buckets []*bolt.Bucket
-		if buckets, err = self.dig(keys[:len(keys)-1], true); err != nil {
+	var postings [][][]byte
+	if postings, _, err = fulltextKeys(id, value, typ); err != nil {
+		return
+	}
+	for _, keys := range append(indexed, postings...) {
+		if err = self.removeIndex(keys); err != nil {
 			return
 		}
-		if err = buckets[len(buckets)-1].Delete(keys[len(keys)-1]); err != nil {
+	}
+	return
+}
+
+/*
+removeIndex deletes the last of keys from the bucket found by digging through the rest of them, and then deletes all buckets left empty.
+*/
+func (self *TX) removeIndex(keys [][]byte) (err error) {
+	buckets, err := self.dig(keys[:len(keys)-1], true)
+	if err != nil {
+		return
+	}
+	bucket := buckets[len(buckets)-1]
+	existed := bucket.Get(keys[len(keys)-1]) != nil
+	if err = bucket.Delete(keys[len(keys)-1]); err != nil {
+		return
+	}
+	if existed {
+		if err = self.count(keys[:len(keys)-1], bucket, -1); err != nil {
 			return
 		}
-		for ; len(buckets) > 1; buckets = buckets[:len(buckets)-1] {
-			stats := buckets[len(buckets)-2].Stats()
-			if stats.BucketN > 1 || stats.KeyN > 0 {
-				break
-			}
-			if err = buckets[len(buckets)-2].DeleteBucket(keys[len(buckets)-1]); err != nil {
-				return
-			}
+	}
+	for ; len(buckets) > 1; buckets = buckets[:len(buckets)-1] {
+		stats := buckets[len(buckets)-2].Stats()
+		if stats.BucketN > 1 || stats.KeyN > 0 {
+			break
+		}
+		if err = buckets[len(buckets)-2].DeleteBucket(keys[len(buckets)-1]); err != nil {
+			return
 		}
 	}
 	return
@@ -206,7 +314,7 @@ func (self *TX) get(id []byte, value reflect.Value, obj interface{}) (err error)
 }
 
 /*
-Clear will empty this TX.
+Clear will empty this TX, including any indexes in an older format.
 */
 func (self *TX) Clear() (err error) {
 	cursor := self.tx.Cursor()
@@ -215,6 +323,7 @@ func (self *TX) Clear() (err error) {
 			return
 		}
 	}
+	self.formatChecked = false
 	return
 }
 
@@ -223,6 +332,7 @@ Set will save obj in this TX.
 If obj has no Id, or if the Id does not already exist in the TX, it will be indexed and created.
 If obj has an Id that exists in the TX, the old object will be loaded and de-indexed, then obj will be indexd and saved.
 Indexed fields have the annotation `unbolted:"index"`.
+Fields with the annotation `unbolted:"unique"` are indexed, and Set will return an ErrUniqueViolation if another object of the same type has the same value in them.
 */
 func (self *TX) Set(obj interface{}) (err error) {
 	value, id, err := identify(obj)
@@ -294,6 +404,13 @@ func (self *TX) Del(obj interface{}) (err error) {
 }
 
 func (self *TX) skipper(b []byte) (result setop.Skipper, err error) {
+	if bytes.Equal(b, emptySource.Key) {
+		result = &skipper{}
+		return
+	}
+	if span, ok := parseSpan(b); ok {
+		return span.skipper(self)
+	}
 	keys := splitKeys(b)
 	buckets, err := self.dig(keys, false)
 	if err != nil {
@@ -309,16 +426,36 @@ func (self *TX) skipper(b []byte) (result setop.Skipper, err error) {
 	return
 }
 
-func (self *TX) setOp(expr *setop.SetExpression) (result []kv) {
-	if err := expr.Each(self.skipper, func(res *setop.SetOpResult) {
-		result = append(result, kv{
+/*
+setOp streams the results of expr to f, and stops all skippers created by skipper as soon as f returns false or an error.
+*/
+func (self *TX) setOp(expr *setop.SetExpression, skipper func(b []byte) (setop.Skipper, error), f func(kv kv) (bool, error)) (err error) {
+	stopped := false
+	var fErr error
+	if err = expr.Each(func(b []byte) (result setop.Skipper, err error) {
+		if result, err = skipper(b); err != nil {
+			return
+		}
+		result = &stoppableSkipper{
+			Skipper: result,
+			stopped: &stopped,
+		}
+		return
+	}, func(res *setop.SetOpResult) {
+		if stopped {
+			return
+		}
+		cont := false
+		if cont, fErr = f(kv{
 			Keys:  [][]byte{res.Key},
 			Value: res.Values[0],
-		})
+		}); fErr != nil || !cont {
+			stopped = true
+		}
 	}); err != nil {
-		panic(err)
+		return
 	}
-	return
+	return fErr
 }
 
 /*
@@ -330,5 +467,8 @@ func (self *TX) Query() *Query {
 		run: func(f func(*TX) error) error {
 			return f(self)
 		},
+		update: func(f func(*TX) error) error {
+			return f(self)
+		},
 	}
 }
@@ -6,9 +6,12 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
 	"math/rand"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +19,7 @@ const (
 	unbolted       = "unbolted"
 	idField        = "Id"
 	index          = "index"
+	unique         = "unique"
 	updatedAtField = "UpdatedAt"
 	createdAtField = "CreatedAt"
 )
@@ -61,8 +65,30 @@ func (self *Id) Equals(o Id) bool {
 var primaryKey = []byte("pk")
 var secondaryIndex = []byte("2i")
 var timeType = reflect.TypeOf(time.Now())
+var indexerType = reflect.TypeOf((*Indexer)(nil)).Elem()
 var ErrNotFound = fmt.Errorf("Not found")
 
+/*
+Indexer can be implemented by types that want to define their own index representation.
+IndexBytes must return bytes that sort like the values they represent, for range filters and ordering on the type to work.
+*/
+type Indexer interface {
+	IndexBytes() ([]byte, error)
+}
+
+/*
+ErrUniqueViolation is returned when an object would get the same value in a field annotated with `unbolted:"unique"` as another object of the same type.
+*/
+type ErrUniqueViolation struct {
+	Type  string
+	Field string
+	Value interface{}
+}
+
+func (self ErrUniqueViolation) Error() string {
+	return fmt.Sprintf("%v.%v %#v is not unique", self.Type, self.Field, self.Value)
+}
+
 func identify(obj interface{}) (value, id reflect.Value, err error) {
 	ptrValue := reflect.ValueOf(obj)
 	if ptrValue.Kind() != reflect.Ptr {
@@ -100,16 +126,271 @@ func randomBytes() (result []byte) {
 	return
 }
 
+func isNumeric(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+/*
+valueBytes returns the index bytes of a query value compared to fieldName in typ, or to the elements of fieldName if it is multi valued.
+Values compared to fields annotated with `unbolted:"fold"` are folded like the field values.
+*/
+func valueBytes(typ reflect.Type, fieldName string, i interface{}) (b []byte, err error) {
+	value := reflect.ValueOf(i)
+	field, _, err := resolveField(typ, fieldName)
+	if err != nil {
+		if !value.IsValid() {
+			err = fmt.Errorf("%v can not be compared to %v.%v", i, typ.Name(), fieldName)
+			return
+		}
+		return indexBytes(value.Type(), value)
+	}
+	if hasParam(field, fold) {
+		value = foldValue(value)
+	}
+	fieldType := field.Type
+	if multiValued(fieldType) {
+		fieldType = fieldType.Elem()
+	}
+	if b, err = fieldValueBytes(fieldType, value); err != nil {
+		err = fmt.Errorf("%v can not be compared to %v.%v: %v", i, typ.Name(), fieldName, err)
+	}
+	return
+}
+
+/*
+boundBytes returns the index bytes of a query value used as the lower or upper bound of a range of fieldName in typ, and whether the bound is inclusive.
+Numeric values that the field can't have are rounded towards the inside of the range and clamped to the values the field can have,
+so that for example Greater{"UintField", -1} matches all values, and Greater{"IntField", 2.5} matches the values from 3.
+*/
+func boundBytes(typ reflect.Type, fieldName string, i interface{}, lower, inc bool) (b []byte, resultInc bool, err error) {
+	resultInc = inc
+	value := reflect.ValueOf(i)
+	if field, _, fieldErr := resolveField(typ, fieldName); fieldErr == nil && value.IsValid() {
+		fieldType := field.Type
+		if multiValued(fieldType) {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Ptr && value.Kind() != reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if value.Type() != fieldType && isNumeric(value.Kind()) && isNumeric(fieldType.Kind()) {
+			if value, resultInc, err = roundBound(fieldType, value, lower, inc); err != nil {
+				err = fmt.Errorf("%v can not be compared to %v.%v: %v", i, typ.Name(), fieldName, err)
+				return
+			}
+			i = value.Interface()
+		}
+	}
+	b, err = valueBytes(typ, fieldName, i)
+	return
+}
+
+/*
+fieldValueBytes returns the index bytes value would have if it was stored in a field of fieldType.
+Numeric values will be converted to the type of the field, so that for example an int can be compared to an int64 field,
+and values compared to pointer fields will be treated as pointers to the value, so that for example nil or an int can be compared to an *int field.
+*/
+func fieldValueBytes(fieldType reflect.Type, value reflect.Value) (b []byte, err error) {
+	if fieldType.Kind() == reflect.Ptr && (!value.IsValid() || value.Kind() != reflect.Ptr) {
+		if !value.IsValid() {
+			b = []byte{0}
+			return
+		}
+		if b, err = fieldValueBytes(fieldType.Elem(), value); err != nil {
+			return
+		}
+		b = append([]byte{1}, b...)
+		return
+	}
+	if !value.IsValid() {
+		err = fmt.Errorf("only pointer fields can be nil")
+		return
+	}
+	if value.Type() != fieldType && isNumeric(value.Kind()) && isNumeric(fieldType.Kind()) {
+		converted := value.Convert(fieldType)
+		var exact, back *big.Float
+		if exact, err = bigNumber(value); err != nil {
+			return
+		}
+		if back, err = bigNumber(converted); err != nil {
+			return
+		}
+		if exact.Cmp(back) != 0 {
+			err = fmt.Errorf("%v can not be converted to %v without loss", value.Interface(), fieldType)
+			return
+		}
+		value = converted
+	}
+	return indexBytes(value.Type(), value)
+}
+
+/*
+bigNumber returns the numeric value as a big.Float, which can represent all int, uint and float values exactly.
+*/
+func bigNumber(value reflect.Value) (result *big.Float, err error) {
+	result = new(big.Float)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		result.SetInt64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		result.SetUint64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		if math.IsNaN(value.Float()) {
+			err = fmt.Errorf("NaN can not be compared")
+			return
+		}
+		result.SetFloat64(value.Float())
+	default:
+		err = fmt.Errorf("%v is not a numeric type", value.Type())
+	}
+	return
+}
+
+/*
+roundInt rounds exact up if it is a lower bound, or down if it is an upper bound, and clamps it between min and max.
+*/
+func roundInt(exact *big.Float, lower bool, min, max *big.Int) (result *big.Int) {
+	if exact.IsInf() {
+		if exact.Sign() < 0 {
+			return min
+		}
+		return max
+	}
+	result, accuracy := exact.Int(nil)
+	if lower && accuracy == big.Below {
+		result.Add(result, big.NewInt(1))
+	} else if !lower && accuracy == big.Above {
+		result.Sub(result, big.NewInt(1))
+	}
+	if result.Cmp(min) < 0 {
+		return min
+	}
+	if result.Cmp(max) > 0 {
+		return max
+	}
+	return
+}
+
+/*
+roundBound converts the numeric value to typ, rounded towards the inside of the range it bounds and clamped to the values of typ,
+and returns whether the converted bound is inclusive, given whether value was.
+*/
+func roundBound(typ reflect.Type, value reflect.Value, lower, inc bool) (result reflect.Value, resultInc bool, err error) {
+	exact, err := bigNumber(value)
+	if err != nil {
+		return
+	}
+	result = reflect.New(typ).Elem()
+	one := big.NewInt(1)
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		max := new(big.Int).Sub(new(big.Int).Lsh(one, uint(typ.Bits()-1)), one)
+		min := new(big.Int).Sub(new(big.Int).Neg(max), one)
+		result.SetInt(roundInt(exact, lower, min, max).Int64())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		max := new(big.Int).Sub(new(big.Int).Lsh(one, uint(typ.Bits())), one)
+		result.SetUint(roundInt(exact, lower, new(big.Int), max).Uint64())
+	case reflect.Float32:
+		f, _ := exact.Float32()
+		result.SetFloat(float64(f))
+	case reflect.Float64:
+		f, _ := exact.Float64()
+		result.SetFloat(f)
+	}
+	converted, err := bigNumber(result)
+	if err != nil {
+		return
+	}
+	switch converted.Cmp(exact) {
+	case 0:
+		resultInc = inc
+	case 1:
+		// Above the bound, so only a lower bound includes it.
+		resultInc = lower
+	default:
+		resultInc = !lower
+	}
+	return
+}
+
+/*
+floatBytes returns the bits of f with the sign bit flipped for positive numbers and all bits flipped for negative numbers, which makes them sort like the numbers.
+Negative zero is encoded like zero, since they are equal, and all NaNs are encoded the same way, sorting after positive infinity.
+*/
+func floatBytes(f float64) (b []byte) {
+	if f == 0 {
+		f = 0
+	} else if math.IsNaN(f) {
+		f = math.NaN()
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	b = make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+	return
+}
+
+/*
+indexBytes returns an order preserving representation of value, so that the bolt cursor order of indexed values matches the order of the values themselves.
+Types implementing Indexer define their own representation.
+Nil pointers are represented by a value sorting before all non nil values.
+*/
 func indexBytes(typ reflect.Type, value reflect.Value) (b []byte, err error) {
+	if typ.Kind() != reflect.Ptr && value.CanInterface() {
+		indexer, ok := value.Interface().(Indexer)
+		if !ok && reflect.PtrTo(typ).Implements(indexerType) {
+			ptr := reflect.New(typ)
+			ptr.Elem().Set(value)
+			indexer = ptr.Interface().(Indexer)
+			ok = true
+		}
+		if ok {
+			if b, err = indexer.IndexBytes(); err != nil {
+				return
+			}
+			if len(b) == 0 {
+				b = []byte{0}
+			}
+			return
+		}
+	}
+	if typ == timeType {
+		t := value.Interface().(time.Time)
+		b = make([]byte, 12)
+		binary.BigEndian.PutUint64(b, uint64(t.Unix())^(1<<63))
+		binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+		return
+	}
 	switch typ.Kind() {
 	case reflect.String:
 		b = []byte(value.String())
-	case reflect.Int:
-		buf := new(bytes.Buffer)
-		if err = binary.Write(buf, binary.BigEndian, value.Int()); err != nil {
-			return
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(value.Int())^(1<<63))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b = make([]byte, 8)
+		binary.BigEndian.PutUint64(b, value.Uint())
+	case reflect.Float32, reflect.Float64:
+		b = floatBytes(value.Float())
+	case reflect.Ptr:
+		if value.IsNil() {
+			b = []byte{0}
+		} else {
+			if b, err = indexBytes(typ.Elem(), value.Elem()); err != nil {
+				return
+			}
+			b = append([]byte{1}, b...)
 		}
-		b = buf.Bytes()
 	case reflect.Slice:
 		switch typ.Elem().Kind() {
 		case reflect.Uint8:
@@ -133,47 +414,308 @@ func indexBytes(typ reflect.Type, value reflect.Value) (b []byte, err error) {
 	return
 }
 
-func indexKey(id []byte, typ reflect.Type, fieldName string, fieldType reflect.Type, fieldValue reflect.Value) (keys [][]byte, err error) {
-	var valuePart []byte
-	if valuePart, err = indexBytes(fieldType, fieldValue); err != nil {
+/*
+indexedValue returns the value of type typ that indexBytes encodes to b.
+ok is false for types whose encoding can't be decoded without losing information, like Indexers, time.Time, floats and empty strings.
+*/
+func indexedValue(typ reflect.Type, b []byte) (result reflect.Value, ok bool) {
+	if typ == timeType || typ.Implements(indexerType) || reflect.PtrTo(typ).Implements(indexerType) {
 		return
 	}
-	keys = [][]byte{
-		secondaryIndex,
-		[]byte(typ.Name()),
-		[]byte(fieldName),
-		valuePart,
-		id,
+	result = reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.String:
+		if bytes.Equal(b, []byte{0}) {
+			return
+		}
+		result.SetString(string(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if len(b) != 8 {
+			return
+		}
+		result.SetInt(int64(binary.BigEndian.Uint64(b) ^ (1 << 63)))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if len(b) != 8 {
+			return
+		}
+		result.SetUint(binary.BigEndian.Uint64(b))
+	case reflect.Bool:
+		if len(b) != 1 {
+			return
+		}
+		result.SetBool(b[0] == 1)
+	case reflect.Ptr:
+		if bytes.Equal(b, []byte{0}) {
+			break
+		}
+		if len(b) < 2 || b[0] != 1 {
+			return
+		}
+		var elem reflect.Value
+		if elem, ok = indexedValue(typ.Elem(), b[1:]); !ok {
+			return
+		}
+		result.Set(reflect.New(typ.Elem()))
+		result.Elem().Set(elem)
+	default:
+		return
 	}
+	return result, true
+}
+
+/*
+multiValued returns whether fields of typ get one index entry for each of their elements.
+*/
+func multiValued(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Slice && typ.Elem().Kind() != reflect.Uint8 && !typ.Implements(indexerType) && !reflect.PtrTo(typ).Implements(indexerType)
+}
+
+/*
+mapped returns whether fields of typ get one index entry for each of their key/value pairs.
+*/
+func mapped(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Map && !typ.Implements(indexerType) && !reflect.PtrTo(typ).Implements(indexerType)
+}
+
+/*
+pairBytes returns the index bytes of a key/value pair of a map of mapType.
+The key comes first, so that all pairs with the same key share the same prefix.
+*/
+func pairBytes(mapType reflect.Type, key, value reflect.Value) (result []byte, err error) {
+	b, err := fieldValueBytes(mapType.Key(), key)
+	if err != nil {
+		return
+	}
+	result = tupleBytes(b)
+	if b, err = fieldValueBytes(mapType.Elem(), value); err != nil {
+		return
+	}
+	result = append(result, tupleBytes(b)...)
 	return
 }
 
-func indexKeys(id []byte, value reflect.Value, typ reflect.Type) (indexed [][][]byte, err error) {
-	alreadyIndexed := make(map[string]bool)
-	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
-		if unboltedTag := field.Tag.Get(unbolted); unboltedTag != "" {
-			for _, param := range strings.Split(unboltedTag, ",") {
-				if param == index {
-					// unbolted:"index"
-					if !alreadyIndexed[field.Name] {
-						// Not already indexed
-						var keys [][]byte
-						// Build an index key
-						keys, err = indexKey(id, typ, field.Name, field.Type, value.Field(i))
-						if err != nil {
-							return
-						}
-						indexed = append(indexed, keys)
-						alreadyIndexed[field.Name] = true
-					}
-				}
+/*
+fieldIndexBytes returns the index bytes of a field value, of each distinct element of a multi valued field, or of each key/value pair of a map field.
+*/
+func fieldIndexBytes(fieldType reflect.Type, fieldValue reflect.Value) (result [][]byte, err error) {
+	if mapped(fieldType) {
+		for _, key := range fieldValue.MapKeys() {
+			var pair []byte
+			if pair, err = pairBytes(fieldType, key, fieldValue.MapIndex(key)); err != nil {
+				return
 			}
+			result = append(result, pair)
+		}
+		return
+	}
+	if !multiValued(fieldType) {
+		var b []byte
+		if b, err = indexBytes(fieldType, fieldValue); err != nil {
+			return
 		}
+		result = [][]byte{b}
+		return
+	}
+	seen := map[string]bool{}
+	for i := 0; i < fieldValue.Len(); i++ {
+		var b []byte
+		if b, err = indexBytes(fieldType.Elem(), fieldValue.Index(i)); err != nil {
+			return
+		}
+		if !seen[string(b)] {
+			seen[string(b)] = true
+			result = append(result, b)
+		}
+	}
+	return
+}
+
+func indexKey(id []byte, typ reflect.Type, fieldName string, fieldType reflect.Type, fieldValue reflect.Value) (keys [][][]byte, err error) {
+	var valueParts [][]byte
+	if valueParts, err = fieldIndexBytes(fieldType, fieldValue); err != nil {
+		return
+	}
+	for _, valuePart := range valueParts {
+		keys = append(keys, [][]byte{
+			secondaryIndex,
+			[]byte(typ.Name()),
+			[]byte(fieldName),
+			valuePart,
+			id,
+		})
 	}
 	return
 }
 
+func hasParam(field reflect.StructField, wanted string) bool {
+	for _, param := range strings.Split(field.Tag.Get(unbolted), ",") {
+		if param == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+pathField is a field of a struct, or of a struct nested in it, and the dotted path naming every field leading to it, including embedded ones.
+*/
+type pathField struct {
+	path  string
+	field reflect.StructField
+}
+
+/*
+walkFields calls f with all fields of typ, and of all structs nested or embedded in it.
+*/
+func walkFields(typ reflect.Type, f func(pathField)) {
+	var walk func(typ reflect.Type, prefix string, visiting map[reflect.Type]bool)
+	walk = func(typ reflect.Type, prefix string, visiting map[reflect.Type]bool) {
+		if visiting[typ] {
+			return
+		}
+		visiting[typ] = true
+		defer delete(visiting, typ)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			f(pathField{
+				path:  prefix + field.Name,
+				field: field,
+			})
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct && fieldType != timeType && !reflect.PtrTo(fieldType).Implements(indexerType) {
+				walk(fieldType, prefix+field.Name+".", visiting)
+			}
+		}
+	}
+	walk(typ, "", map[reflect.Type]bool{})
+}
+
+/*
+typeCache keeps values computed from the fields and tags of types, since walking them for every object indexed or query planned is slow.
+The cached values are shared, and must not be changed.
+*/
+type typeCache struct {
+	values sync.Map
+}
+
+/*
+get returns the value cached for typ, computing it with f if there is none.
+*/
+func (self *typeCache) get(typ reflect.Type, f func() interface{}) (result interface{}) {
+	result, found := self.values.Load(typ)
+	if !found {
+		result, _ = self.values.LoadOrStore(typ, f())
+	}
+	return
+}
+
+var indexedFieldsCache typeCache
+
+/*
+indexedFields returns the fields of typ, and of all structs nested or embedded in it, annotated with `unbolted:"index"` or `unbolted:"unique"`.
+Fields also annotated with `unbolted:"fold"` are indexed case and accent insensitively.
+*/
+func indexedFields(typ reflect.Type) []pathField {
+	return indexedFieldsCache.get(typ, func() interface{} {
+		var result []pathField
+		walkFields(typ, func(field pathField) {
+			if hasParam(field.field, index) || hasParam(field.field, unique) {
+				result = append(result, field)
+			}
+		})
+		return result
+	}).([]pathField)
+}
+
+/*
+resolveField finds the field named by path in typ, where path is a dotted path of field names through nested structs, and each name can be promoted from an embedded struct.
+canonical is the path naming every field leading to the field, including the embedded ones, and is what indexes are named after.
+*/
+func resolveField(typ reflect.Type, path string) (field reflect.StructField, canonical string, err error) {
+	var names []string
+	for _, part := range strings.Split(path, ".") {
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typ.Kind() != reflect.Struct {
+			err = fmt.Errorf("%v is not a struct, and has no field %v", typ, part)
+			return
+		}
+		found := false
+		if field, found = typ.FieldByName(part); !found {
+			err = fmt.Errorf("%v has no field %v", typ, part)
+			return
+		}
+		for i := range field.Index {
+			names = append(names, typ.FieldByIndex(field.Index[:i+1]).Name)
+		}
+		typ = field.Type
+	}
+	canonical = strings.Join(names, ".")
+	return
+}
+
+/*
+canonicalField returns the canonical path of the field named by path in typ, or path if it can't be resolved.
+*/
+func canonicalField(typ reflect.Type, path string) string {
+	if _, canonical, err := resolveField(typ, path); err == nil {
+		return canonical
+	}
+	return path
+}
+
+/*
+fieldValue returns the field at the canonical path in value, or the zero value of fieldType if a pointer to a struct on the way is nil.
+*/
+func fieldValue(value reflect.Value, canonical string, fieldType reflect.Type) reflect.Value {
+	for _, name := range strings.Split(canonical, ".") {
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return reflect.Zero(fieldType)
+			}
+			value = value.Elem()
+		}
+		value = value.FieldByName(name)
+	}
+	return value
+}
+
+func indexKeys(id []byte, value reflect.Value, typ reflect.Type) (indexed [][][]byte, err error) {
+	// unbolted:"index" or unbolted:"unique"
+	for _, field := range indexedFields(typ) {
+		var keys [][][]byte
+		// Build the index keys
+		keys, err = indexKey(id, typ, field.path, field.field.Type, indexValue(field.field, fieldValue(value, field.path, field.field.Type)))
+		if err != nil {
+			return
+		}
+		indexed = append(indexed, keys...)
+	}
+	for _, composite := range compositeIndexes(typ) {
+		var keys [][]byte
+		if keys, err = composite.key(id, value, typ); err != nil {
+			return
+		}
+		indexed = append(indexed, keys)
+	}
+	return
+}
+
+/*
+indexed returns whether the field at path in typ is annotated with `unbolted:"index"` or `unbolted:"unique"`.
+*/
+func indexed(typ reflect.Type, path string) bool {
+	field, _, err := resolveField(typ, path)
+	if err != nil {
+		return false
+	}
+	return hasParam(field, index) || hasParam(field, unique)
+}
+
 func escape(bs []byte) (result []byte) {
 	for index := 0; index < len(bs); index++ {
 		if bs[index] == 0 {
@@ -196,7 +738,7 @@ func joinKeys(keys [][]byte) (result []byte) {
 func splitKeys(key []byte) (result [][]byte) {
 	var last []byte
 	for index := 0; index < len(key); index++ {
-		if key[index] == 0 {
+		if key[index] == 0 && index+1 < len(key) {
 			if key[index+1] == 1 {
 				result = append(result, last)
 				last = nil
@@ -2,15 +2,21 @@ package unbolted
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"reflect"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/zond/setop"
 )
 
 type benchStruct0 struct {
@@ -731,3 +737,2289 @@ func TestChains(t *testing.T) {
 		t.Fatalf("Didn't get the user update!")
 	}
 }
+
+type rangeStruct struct {
+	Id       []byte
+	Priority int       `unbolted:"index"`
+	Total    int64     `unbolted:"index"`
+	Score    float64   `unbolted:"index"`
+	At       time.Time `unbolted:"index"`
+}
+
+func assertPriorities(t *testing.T, d *DB, filter QFilter, wanted ...int) {
+	var res []rangeStruct
+	if err := d.Query().Where(filter).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	found := map[int]bool{}
+	for _, r := range res {
+		found[r.Priority] = true
+	}
+	if len(found) != len(wanted) || len(res) != len(wanted) {
+		t.Fatalf("%+v: wanted %v but got %+v", filter, wanted, res)
+	}
+	for _, w := range wanted {
+		if !found[w] {
+			t.Fatalf("%+v: wanted %v but got %+v", filter, wanted, res)
+		}
+	}
+}
+
+func TestRangeQuery(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	now := time.Now()
+	for _, prio := range []int{-500, -5, -1, 0, 3, 10, 300} {
+		if err := d.Set(&rangeStruct{
+			Priority: prio,
+			Total:    int64(prio) * 100,
+			Score:    float64(prio) / 2,
+			At:       now.Add(time.Duration(prio) * time.Hour),
+		}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	assertPriorities(t, d, Greater{"Priority", -2}, -1, 0, 3, 10, 300)
+	assertPriorities(t, d, GreaterOrEqual{"Priority", 3}, 3, 10, 300)
+	assertPriorities(t, d, Less{"Priority", 0}, -500, -5, -1)
+	assertPriorities(t, d, LessOrEqual{"Priority", 0}, -500, -5, -1, 0)
+	assertPriorities(t, d, Between{"Priority", -1, 3}, -1, 0, 3)
+	assertPriorities(t, d, Between{"Priority", 4, 9})
+	assertPriorities(t, d, Between{"Total", -500, 1000}, -5, -1, 0, 3, 10)
+	assertPriorities(t, d, Less{"Score", -0.5}, -500, -5)
+	assertPriorities(t, d, Between{"Score", -0.5, 1.5}, -1, 0, 3)
+	assertPriorities(t, d, Greater{"At", now.Add(time.Hour * 5)}, 10, 300)
+	assertPriorities(t, d, Less{"At", now.Add(-time.Hour)}, -500, -5)
+	assertPriorities(t, d, And{Greater{"Priority", -10}, Less{"Score", 2}}, -5, -1, 0, 3)
+	assertPriorities(t, d, Or{Less{"Priority", -10}, Greater{"Total", 500}}, -500, 10, 300)
+	explanation, err := d.Query().Where(Greater{"At", now}).Explain(&rangeStruct{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if span := explanation.Plan.Sources[1]; span.Operation != "source" || !strings.HasPrefix(span.Key, "2i/rangeStruct/At(") {
+		t.Errorf("Wanted the range to be a single source, got %v", explanation)
+	}
+	r := reflect.ValueOf(rangeStruct{Priority: 5, Score: 2.5})
+	if m, err := (Between{"Priority", 0, 5}).match(nil, r.Type(), r); err != nil || !m {
+		t.Fatalf("Wanted match, got %v, %v", m, err)
+	}
+	if m, err := (Greater{"Score", 2.5}).match(nil, r.Type(), r); err != nil || m {
+		t.Fatalf("Wanted no match, got %v, %v", m, err)
+	}
+}
+
+type boundStruct struct {
+	Id    []byte
+	N     uint `unbolted:"index"`
+	Small int8 `unbolted:"index"`
+}
+
+func TestRangeBounds(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for n := 0; n < 7; n++ {
+		if err := d.Set(&boundStruct{N: uint(n), Small: int8(n - 3)}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		filter QFilter
+		wanted int
+	}{
+		{Greater{"N", -1}, 7},
+		{GreaterOrEqual{"N", -1}, 7},
+		{Less{"N", -1}, 0},
+		{LessOrEqual{"N", -1}, 0},
+		{Greater{"N", 2.5}, 4},
+		{GreaterOrEqual{"N", 2.5}, 4},
+		{Less{"N", 2.5}, 3},
+		{LessOrEqual{"N", 2.5}, 3},
+		{Between{"N", 1.5, 4.5}, 3},
+		{Between{"N", -10, 1e30}, 7},
+		{Greater{"Small", 1000}, 0},
+		{Less{"Small", 1000}, 7},
+		{Less{"Small", -1000}, 0},
+		{GreaterOrEqual{"Small", -0.5}, 4},
+	} {
+		if count, err := d.Query().Where(c.filter).Count(&boundStruct{}); err != nil {
+			t.Errorf("%+v: %v", c.filter, err)
+		} else if count != c.wanted {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, count)
+		}
+		value := reflect.ValueOf(boundStruct{N: 3, Small: 0})
+		if m, err := c.filter.match(nil, value.Type(), value); err != nil {
+			t.Errorf("%+v: %v", c.filter, err)
+		} else if found, _ := d.Query().Where(And{c.filter, Equals{"N", 3}}).Exists(&boundStruct{}); m != found {
+			t.Errorf("%+v: match of 3 was %v, but the index said %v", c.filter, m, found)
+		}
+	}
+	if _, err := d.Query().Where(Equals{"N", -1}).Count(&boundStruct{}); err == nil {
+		t.Errorf("Wanted an error comparing a uint to -1")
+	}
+	if _, err := d.Query().Where(Equals{"N", 2.5}).Count(&boundStruct{}); err == nil {
+		t.Errorf("Wanted an error comparing a uint to 2.5")
+	}
+}
+
+type pointerBound struct {
+	Id []byte
+	P  *int `unbolted:"index"`
+}
+
+func TestRangeNil(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, p := range []*int{nil, intPointer(1), intPointer(5), intPointer(9)} {
+		if err := d.Set(&pointerBound{P: p}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	nilValue := reflect.ValueOf(pointerBound{})
+	for _, c := range []struct {
+		filter QFilter
+		wanted int
+	}{
+		{Less{"P", 5}, 1},
+		{LessOrEqual{"P", 5}, 2},
+		{Between{"P", nil, 5}, 2},
+		{Greater{"P", nil}, 3},
+		{GreaterOrEqual{"P", 0}, 3},
+		{LessOrEqual{"P", nil}, 0},
+		{Not{Less{"P", 5}}, 3},
+	} {
+		if count, err := d.Query().Where(c.filter).Count(&pointerBound{}); err != nil {
+			t.Errorf("%+v: %v", c.filter, err)
+		} else if count != c.wanted {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, count)
+		}
+		if _, ok := c.filter.(Not); ok {
+			continue
+		}
+		if m, err := c.filter.match(nil, nilValue.Type(), nilValue); err != nil || m {
+			t.Errorf("%+v: wanted no match for nil, got %v, %v", c.filter, m, err)
+		}
+	}
+}
+
+func intPointer(i int) *int {
+	return &i
+}
+
+type floatStruct struct {
+	Id []byte
+	F  float64 `unbolted:"index"`
+}
+
+func TestFloatEncoding(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, f := range []float64{-1, math.Copysign(0, -1), 0, 1} {
+		if err := d.Set(&floatStruct{F: f}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		filter QFilter
+		wanted int
+	}{
+		{Equals{"F", 0.0}, 2},
+		{Equals{"F", math.Copysign(0, -1)}, 2},
+		{Less{"F", 0.0}, 1},
+		{GreaterOrEqual{"F", 0.0}, 3},
+		{Between{"F", math.Copysign(0, -1), 1.0}, 3},
+		{Less{"F", math.Inf(-1)}, 0},
+		{Less{"F", math.Inf(1)}, 4},
+		{Greater{"F", math.Inf(1)}, 0},
+		{Equals{"F", math.NaN()}, 0},
+	} {
+		if count, err := d.Query().Where(c.filter).Count(&floatStruct{}); err != nil {
+			t.Errorf("%+v: %v", c.filter, err)
+		} else if count != c.wanted {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, count)
+		}
+	}
+	negativeNaN := math.Float64frombits(math.Float64bits(math.NaN()) | 1<<63)
+	if !bytes.Equal(floatBytes(negativeNaN), floatBytes(math.NaN())) || bytes.Compare(floatBytes(math.NaN()), floatBytes(math.Inf(1))) < 1 {
+		t.Errorf("Wanted all NaNs to sort after +Inf")
+	}
+}
+
+func TestIndexFormat(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, prio := range []int{-5, 0, 5} {
+		if err := d.Set(&rangeStruct{Priority: prio}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := d.Set(&orderStruct{Name: "a"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Make the indexes look like they were written before the format was versioned, with ints in two's complement.
+	if err := d.Update(func(tx *TX) (err error) {
+		priority := int64(-3)
+		old := make([]byte, 8)
+		binary.BigEndian.PutUint64(old, uint64(priority))
+		if _, err = tx.dig([][]byte{secondaryIndex, []byte("rangeStruct"), []byte("Priority"), old}, true); err != nil {
+			return
+		}
+		if err = tx.tx.DeleteBucket(cardinalityKey); err != nil {
+			return
+		}
+		return tx.tx.DeleteBucket(metaKey)
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := d.Query().Where(Greater{"Priority", -10}).Count(&rangeStruct{}); err != ErrIndexFormat {
+		t.Errorf("Wanted ErrIndexFormat when querying old indexes, got %v", err)
+	}
+	if err := d.Set(&rangeStruct{Priority: 1}); err != ErrIndexFormat {
+		t.Errorf("Wanted ErrIndexFormat when indexing into old indexes, got %v", err)
+	}
+	if count, err := d.Query().Count(&rangeStruct{}); err != nil || count != 3 {
+		t.Errorf("Wanted 3 objects without using indexes, got %v, %v", count, err)
+	}
+	if err := d.Reindex(&rangeStruct{}); err == nil {
+		t.Errorf("Wanted an error when not reindexing all indexed types")
+	}
+	if err := d.Reindex(&rangeStruct{}, &orderStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertPriorities(t, d, Greater{"Priority", -10}, -5, 0, 5)
+	assertPriorities(t, d, Less{"Priority", 0}, -5)
+	if count, err := d.Query().Where(Equals{"Name", "a"}).Count(&orderStruct{}); err != nil || count != 1 {
+		t.Errorf("Wanted the reindexed orderStruct, got %v, %v", count, err)
+	}
+	if err := d.View(func(tx *TX) error {
+		key := joinKeys([][]byte{secondaryIndex, []byte("orderStruct"), []byte("Name"), []byte("a")})
+		if got := tx.cardinality(setop.SetOpSource{Key: key}); got != 1 {
+			t.Errorf("Wanted the count to be rebuilt, got %v", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+type orderStruct struct {
+	Id   []byte
+	Name string `unbolted:"index"`
+	Rank int    `unbolted:"index"`
+}
+
+func orderNames(res []orderStruct) (result []string) {
+	for _, r := range res {
+		result = append(result, fmt.Sprintf("%v%v", r.Name, r.Rank))
+	}
+	return
+}
+
+func TestOrderBy(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, o := range []orderStruct{{Name: "b", Rank: 2}, {Name: "a", Rank: -3}, {Name: "c", Rank: 1}, {Name: "a", Rank: 7}, {Name: "b", Rank: 0}} {
+		cpy := o
+		if err := d.Set(&cpy); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		query  *Query
+		wanted []string
+	}{
+		{d.Query().OrderBy("Rank", Asc), []string{"a-3", "b0", "c1", "b2", "a7"}},
+		{d.Query().OrderBy("Rank", Desc), []string{"a7", "b2", "c1", "b0", "a-3"}},
+		{d.Query().OrderBy("Rank", Desc).Limit(2), []string{"a7", "b2"}},
+		{d.Query().OrderBy("Name", Asc).OrderBy("Rank", Desc), []string{"a7", "a-3", "b2", "b0", "c1"}},
+		{d.Query().OrderBy("Name", Desc).OrderBy("Rank", Asc), []string{"c1", "b0", "b2", "a-3", "a7"}},
+		{d.Query().Where(Greater{"Rank", 0}).OrderBy("Name", Asc).OrderBy("Rank", Asc), []string{"a7", "b2", "c1"}},
+		{d.Query().Where(Equals{"Name", "b"}).Except(Equals{"Rank", 0}).OrderBy("Rank", Asc), []string{"b2"}},
+	} {
+		var res []orderStruct
+		if err := c.query.All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := orderNames(res); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("Wanted %v but got %v", c.wanted, got)
+		}
+	}
+	var res []testStruct
+	if err := d.Query().OrderBy("Email", Asc).All(&res); err == nil {
+		t.Fatalf("Wanted an error when ordering by a non indexed field")
+	}
+}
+
+func TestPage(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, o := range []orderStruct{{Name: "b", Rank: 2}, {Name: "a", Rank: -3}, {Name: "c", Rank: 1}, {Name: "a", Rank: 7}, {Name: "b", Rank: 0}, {Name: "b", Rank: 2}, {Name: "c", Rank: 4}} {
+		cpy := o
+		if err := d.Set(&cpy); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, newQuery := range []func() *Query{
+		func() *Query { return d.Query() },
+		func() *Query { return d.Query().Where(Greater{"Rank", -1}) },
+		func() *Query { return d.Query().OrderBy("Rank", Desc) },
+		func() *Query { return d.Query().OrderBy("Name", Asc).OrderBy("Rank", Desc) },
+		func() *Query { return d.Query().OrderBy("Name", Desc).OrderBy("Rank", Asc) },
+	} {
+		var all []orderStruct
+		if err := newQuery().All(&all); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var paged []orderStruct
+		token := ""
+		pages := 0
+		for {
+			var page []orderStruct
+			if token, err = newQuery().After(token).Limit(3).Page(&page); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(page) > 3 {
+				t.Fatalf("Wanted at most 3 results, got %v", page)
+			}
+			paged = append(paged, page...)
+			pages++
+			if token == "" {
+				break
+			}
+		}
+		if !reflect.DeepEqual(all, paged) {
+			t.Errorf("Wanted %v but got %v", orderNames(all), orderNames(paged))
+		}
+		if wanted := (len(all) + 2) / 3; pages != wanted {
+			t.Errorf("Wanted %v pages but got %v", wanted, pages)
+		}
+	}
+	var page []orderStruct
+	if _, err := d.Query().OrderBy("Rank", Asc).After("AAAA").Page(&page); err == nil {
+		t.Fatalf("Wanted an error for an invalid token")
+	}
+}
+
+func TestEach(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		if err := d.Set(&orderStruct{Name: "a", Rank: i}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		query  *Query
+		stop   int
+		wanted int
+	}{
+		{d.Query(), 100, 10},
+		{d.Query(), 3, 3},
+		{d.Query().Limit(2), 100, 2},
+		{d.Query().Where(Greater{"Rank", 4}), 100, 5},
+		{d.Query().Where(Equals{"Name", "a"}).OrderBy("Rank", Desc), 4, 4},
+	} {
+		var ranks []int
+		if err := c.query.Each(&orderStruct{}, func(obj interface{}) (cont bool, err error) {
+			ranks = append(ranks, obj.(*orderStruct).Rank)
+			return len(ranks) < c.stop, nil
+		}); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if len(ranks) != c.wanted {
+			t.Errorf("Wanted %v results, got %v", c.wanted, ranks)
+		}
+	}
+	wantedErr := fmt.Errorf("stop")
+	calls := 0
+	if err := d.Query().Each(&orderStruct{}, func(obj interface{}) (bool, error) {
+		calls++
+		return true, wantedErr
+	}); err != wantedErr || calls != 1 {
+		t.Fatalf("Wanted %v after 1 call, got %v after %v", wantedErr, err, calls)
+	}
+}
+
+func TestCountExists(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		if err := d.Set(&orderStruct{Name: fmt.Sprint(i % 3), Rank: i}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		query  *Query
+		wanted int
+	}{
+		{d.Query(), 10},
+		{d.Query().Limit(4), 4},
+		{d.Query().Where(Equals{"Name", "0"}), 4},
+		{d.Query().Where(And{Equals{"Name", "1"}, Greater{"Rank", 3}}), 2},
+		{d.Query().Where(Equals{"Name", "2"}).Except(Equals{"Rank", 5}).OrderBy("Rank", Asc), 2},
+		{d.Query().Where(Equals{"Name", "3"}), 0},
+	} {
+		count, err := c.query.Count(&orderStruct{})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if count != c.wanted {
+			t.Errorf("Wanted %v, got %v", c.wanted, count)
+		}
+		exists, err := c.query.Exists(&orderStruct{})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if exists != (c.wanted > 0) {
+			t.Errorf("Wanted %v, got %v", c.wanted > 0, exists)
+		}
+	}
+}
+
+type uniqueStruct struct {
+	Id    []byte
+	Email string `unbolted:"unique"`
+	Name  string
+}
+
+type optionalUnique struct {
+	Id    []byte
+	Email *string `unbolted:"unique"`
+	Name  string
+}
+
+func TestUnique(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	a := &uniqueStruct{Email: "a@b.c", Name: "a"}
+	if err := d.Set(a); err != nil {
+		t.Fatalf(err.Error())
+	}
+	a.Name = "aa"
+	if err := d.Set(a); err != nil {
+		t.Fatalf("Wanted to be able to update an object without changing its unique field, got %v", err)
+	}
+	b := &uniqueStruct{Email: "a@b.c", Name: "b"}
+	err = d.Set(b)
+	if violation, ok := err.(ErrUniqueViolation); !ok || violation.Field != "Email" || violation.Value != "a@b.c" {
+		t.Fatalf("Wanted an ErrUniqueViolation for Email, got %#v", err)
+	}
+	assertSize(t, d, &uniqueStruct{}, 1)
+	b.Email = "b@b.c"
+	if err := d.Set(b); err != nil {
+		t.Fatalf(err.Error())
+	}
+	b.Email = "a@b.c"
+	if _, ok := d.Set(b).(ErrUniqueViolation); !ok {
+		t.Fatalf("Wanted an ErrUniqueViolation when updating to an existing value")
+	}
+	var res []uniqueStruct
+	if err := d.Query().Where(Equals{"Email", "b@b.c"}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != 1 || res[0].Name != "b" {
+		t.Fatalf("Wanted the failed update to leave b untouched, got %+v", res)
+	}
+	if err := d.Del(a); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Set(b); err != nil {
+		t.Fatalf("Wanted to be able to take a value after deleting its owner, got %v", err)
+	}
+	for _, name := range []string{"c", "d"} {
+		if err := d.Set(&optionalUnique{Name: name}); err != nil {
+			t.Fatalf("Wanted several objects to be able to have a nil unique field, got %v", err)
+		}
+	}
+	email := "c@d.e"
+	if err := d.Set(&optionalUnique{Name: "e", Email: &email}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, ok := d.Set(&optionalUnique{Name: "f", Email: &email}).(ErrUniqueViolation); !ok {
+		t.Fatalf("Wanted an ErrUniqueViolation for a non nil pointer")
+	}
+}
+
+type ticket struct {
+	Id       []byte
+	Owner    string `unbolted:"index:owner_status,index:owner_priority"`
+	Status   string `unbolted:"index:owner_status"`
+	Priority int    `unbolted:"index:owner_priority"`
+}
+
+func ticketPriorities(res []ticket) (result []int) {
+	for _, r := range res {
+		result = append(result, r.Priority)
+	}
+	return
+}
+
+func TestCompositeIndex(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tickets := []*ticket{
+		{Owner: "x", Status: "open", Priority: 1},
+		{Owner: "x", Status: "open", Priority: 5},
+		{Owner: "x", Status: "closed", Priority: 3},
+		{Owner: "x\x00", Status: "open", Priority: 4},
+		{Owner: "y", Status: "open", Priority: 2},
+		{Owner: "y", Status: "closed", Priority: 5},
+		{Owner: "x", Status: "closed", Priority: 5},
+	}
+	for _, ticket := range tickets {
+		if err := d.Set(ticket); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	tickets[2].Status = "open"
+	if err := d.Set(tickets[2]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, c := range []struct {
+		query  *Query
+		wanted []int
+	}{
+		{d.Query().Where(And{Equals{"Owner", "x"}, Equals{"Status", "open"}}).OrderBy("Priority", Asc), []int{1, 3, 5}},
+		{d.Query().Where(And{Equals{"Owner", "x"}, Equals{"Status", "closed"}}), []int{5}},
+		{d.Query().Where(And{Equals{"Status", "open"}, Equals{"Owner", "y"}}), []int{2}},
+		{d.Query().Where(Equals{"Owner", "x"}).OrderBy("Priority", Asc), []int{1, 3, 5, 5}},
+		{d.Query().Where(Equals{"Owner", "x"}).OrderBy("Priority", Desc), []int{5, 5, 3, 1}},
+		{d.Query().Select("Priority").Where(Equals{"Owner", "x"}).OrderBy("Priority", Desc), []int{5, 5, 3, 1}},
+		{d.Query().Where(And{Equals{"Owner", "x"}, Greater{"Priority", 1}}).OrderBy("Priority", Desc).Limit(3), []int{5, 5, 3}},
+		{d.Query().Where(And{Equals{"Owner", "x"}, Between{"Priority", 2, 4}}), []int{3}},
+		{d.Query().Where(And{Equals{"Owner", "x\x00"}, Less{"Priority", 10}}), []int{4}},
+	} {
+		var res []ticket
+		if err := c.query.All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		got := ticketPriorities(res)
+		if len(c.query.orders) == 0 {
+			sort.Ints(got)
+		}
+		if !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("Wanted %v but got %v", c.wanted, got)
+		}
+	}
+	var paged []ticket
+	token := ""
+	for {
+		var page []ticket
+		if token, err = d.Query().Where(Equals{"Owner", "x"}).OrderBy("Priority", Desc).After(token).Limit(1).Page(&page); err != nil {
+			t.Fatalf(err.Error())
+		}
+		paged = append(paged, page...)
+		if token == "" {
+			break
+		}
+	}
+	if got := ticketPriorities(paged); !reflect.DeepEqual(got, []int{5, 5, 3, 1}) {
+		t.Errorf("Wanted [5 5 3 1] but got %v", got)
+	}
+}
+
+type kindStruct struct {
+	Id        []byte
+	U8        uint8      `unbolted:"index"`
+	U64       uint64     `unbolted:"index"`
+	I8        int8       `unbolted:"index"`
+	F32       float32    `unbolted:"index"`
+	P         *int       `unbolted:"index"`
+	At        *time.Time `unbolted:"index"`
+	CreatedAt time.Time  `unbolted:"index"`
+	UpdatedAt time.Time  `unbolted:"index"`
+}
+
+func TestIndexKinds(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	one, two := 1, 2
+	now := time.Now()
+	objs := []*kindStruct{
+		{U8: 1, U64: 1 << 40, I8: -3, F32: -1.5, P: &one},
+		{U8: 200, U64: 5, I8: 4, F32: 2.5, P: &two, At: &now},
+		{U8: 7, U64: 1 << 63, I8: 0, F32: 0},
+	}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	time.Sleep(time.Millisecond)
+	objs[2].I8 = -100
+	if err := d.Set(objs[2]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, c := range []struct {
+		filter QFilter
+		wanted []uint8
+	}{
+		{Greater{"U8", 6}, []uint8{7, 200}},
+		{Greater{"U64", 1 << 40}, []uint8{7}},
+		{Less{"U64", uint64(1) << 41}, []uint8{1, 200}},
+		{Less{"I8", 0}, []uint8{1, 7}},
+		{Between{"F32", -1.5, 0}, []uint8{1, 7}},
+		{Equals{"P", nil}, []uint8{7}},
+		{Equals{"P", 2}, []uint8{200}},
+		{Equals{"P", &one}, []uint8{1}},
+		{Greater{"P", 0}, []uint8{1, 200}},
+		{Equals{"At", now}, []uint8{200}},
+		{Equals{"At", nil}, []uint8{1, 7}},
+		{Greater{"UpdatedAt", objs[1].UpdatedAt}, []uint8{7}},
+		{LessOrEqual{"CreatedAt", objs[1].CreatedAt}, []uint8{1, 200}},
+	} {
+		var res []kindStruct
+		if err := d.Query().Where(c.filter).OrderBy("U8", Asc).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []uint8
+		for _, r := range res {
+			got = append(got, r.U8)
+		}
+		if !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, got)
+		}
+		for _, obj := range objs {
+			value := reflect.ValueOf(obj).Elem()
+			if m, err := c.filter.match(nil, value.Type(), value); err != nil {
+				t.Fatalf(err.Error())
+			} else if wanted := sort.Search(len(c.wanted), func(i int) bool { return c.wanted[i] >= obj.U8 }); m != (wanted < len(c.wanted) && c.wanted[wanted] == obj.U8) {
+				t.Errorf("%+v: wrong match %v for %+v", c.filter, m, obj)
+			}
+		}
+	}
+	var res []kindStruct
+	if err := d.Query().Where(Equals{"U8", -1}).All(&res); err == nil {
+		t.Fatalf("Wanted an error comparing -1 to a uint8")
+	}
+	if err := d.Query().Where(Equals{"U8", nil}).All(&res); err == nil {
+		t.Fatalf("Wanted an error comparing nil to a uint8")
+	}
+}
+
+type version string
+
+func (self version) IndexBytes() (result []byte, err error) {
+	for _, part := range strings.Split(string(self), ".") {
+		var i uint16
+		if _, err = fmt.Sscanf(part, "%d", &i); err != nil {
+			return
+		}
+		result = append(result, byte(i>>8), byte(i))
+	}
+	return
+}
+
+type money struct {
+	Cents int64
+}
+
+func (self *money) IndexBytes() ([]byte, error) {
+	return indexBytes(reflect.TypeOf(self.Cents), reflect.ValueOf(self.Cents))
+}
+
+type release struct {
+	Id      []byte
+	Version version `unbolted:"index"`
+	Price   money   `unbolted:"index"`
+}
+
+func TestIndexer(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for index, v := range []version{"1.9.0", "1.10.0", "1.2.3", "2.0.0"} {
+		if err := d.Set(&release{Version: v, Price: money{int64(index*100 - 150)}}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	var res []release
+	if err := d.Query().Where(Greater{"Version", version("1.9.5")}).OrderBy("Version", Asc).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != 2 || res[0].Version != "1.10.0" || res[1].Version != "2.0.0" {
+		t.Fatalf("Wanted 1.10.0 and 2.0.0, got %+v", res)
+	}
+	res = nil
+	if err := d.Query().Where(Less{"Price", money{0}}).OrderBy("Price", Desc).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != 2 || res[0].Version != "1.10.0" || res[1].Version != "1.9.0" {
+		t.Fatalf("Wanted 1.10.0 and 1.9.0, got %+v", res)
+	}
+	res = nil
+	if err := d.Query().Where(Equals{"Price", money{50}}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != 1 || res[0].Version != "1.2.3" {
+		t.Fatalf("Wanted 1.2.3, got %+v", res)
+	}
+	if err := d.Set(&release{Version: "x"}); err == nil {
+		t.Fatalf("Wanted the IndexBytes error")
+	}
+}
+
+type tagged struct {
+	Id   []byte
+	Name string
+	Tags []string `unbolted:"index"`
+	Nums []int    `unbolted:"index"`
+}
+
+func taggedNames(t *testing.T, q *Query) (result []string) {
+	var res []tagged
+	if err := q.All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, r := range res {
+		result = append(result, r.Name)
+	}
+	sort.Strings(result)
+	return
+}
+
+func TestMultiValued(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	objs := []*tagged{
+		{Name: "a", Tags: []string{"x", "y", "x"}, Nums: []int{1, 5}},
+		{Name: "b", Tags: []string{"y", "z"}, Nums: []int{-3}},
+		{Name: "c"},
+		{Name: "d", Tags: []string{"w"}, Nums: []int{2, 3}},
+	}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	objs[3].Tags = []string{"x"}
+	if err := d.Set(objs[3]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, c := range []struct {
+		filter QFilter
+		wanted []string
+	}{
+		{Contains{"Tags", "x"}, []string{"a", "d"}},
+		{Contains{"Tags", "y"}, []string{"a", "b"}},
+		{Contains{"Tags", "w"}, nil},
+		{ContainsAll{"Tags", []interface{}{"x", "y"}}, []string{"a"}},
+		{ContainsAll{"Tags", []interface{}{"y", "z"}}, []string{"b"}},
+		{ContainsAll{"Tags", []interface{}{"x", "z"}}, nil},
+		{Greater{"Nums", 2}, []string{"a", "d"}},
+		{And{Contains{"Tags", "y"}, Less{"Nums", 0}}, []string{"b"}},
+	} {
+		if got := taggedNames(t, d.Query().Where(c.filter)); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, got)
+		}
+		for _, obj := range objs {
+			value := reflect.ValueOf(obj).Elem()
+			m, err := c.filter.match(nil, value.Type(), value)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			wanted := false
+			for _, name := range c.wanted {
+				wanted = wanted || name == obj.Name
+			}
+			if m != wanted {
+				t.Errorf("%+v: wrong match %v for %+v", c.filter, m, obj)
+			}
+		}
+	}
+	if count, err := d.Query().Where(Contains{"Tags", "x"}).Count(&tagged{}); err != nil || count != 2 {
+		t.Fatalf("Wanted 2, got %v, %v", count, err)
+	}
+	if err := d.Query().OrderBy("Nums", Asc).All(&[]tagged{}); err == nil {
+		t.Fatalf("Wanted an error when ordering by a multi valued field")
+	}
+}
+
+type Address struct {
+	City string `unbolted:"index"`
+	Zip  int    `unbolted:"index"`
+}
+
+type geo struct {
+	Lat float64 `unbolted:"index"`
+}
+
+type person struct {
+	Id []byte
+	Address
+	Name string
+	Home *geo
+	Work Address
+}
+
+func personNames(t *testing.T, q *Query) (result []string) {
+	var res []person
+	if err := q.All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, r := range res {
+		result = append(result, r.Name)
+	}
+	return
+}
+
+func TestNestedFields(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	people := []*person{
+		{Name: "a", Address: Address{City: "Oslo", Zip: 1}, Home: &geo{Lat: 59.9}, Work: Address{City: "Bergen"}},
+		{Name: "b", Address: Address{City: "Stockholm", Zip: 2}, Home: &geo{Lat: -10}, Work: Address{City: "Oslo"}},
+		{Name: "c", Address: Address{City: "Oslo", Zip: 3}},
+	}
+	for _, p := range people {
+		if err := d.Set(p); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		query  *Query
+		wanted []string
+	}{
+		{d.Query().Where(Equals{"Address.City", "Oslo"}).OrderBy("Zip", Asc), []string{"a", "c"}},
+		{d.Query().Where(Equals{"City", "Oslo"}).OrderBy("Address.Zip", Desc), []string{"c", "a"}},
+		{d.Query().Where(Equals{"Work.City", "Oslo"}), []string{"b"}},
+		{d.Query().Where(Greater{"Home.Lat", 0}), []string{"a"}},
+		{d.Query().Where(Equals{"Home.Lat", 0}), []string{"c"}},
+		{d.Query().OrderBy("Home.Lat", Asc), []string{"b", "c", "a"}},
+	} {
+		if got := personNames(t, c.query); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("Wanted %v but got %v", c.wanted, got)
+		}
+	}
+	value := reflect.ValueOf(people[1]).Elem()
+	for _, filter := range []QFilter{Equals{"Work.City", "Oslo"}, Equals{"City", "Stockholm"}, Less{"Home.Lat", 0}} {
+		if m, err := filter.match(nil, value.Type(), value); err != nil || !m {
+			t.Errorf("%+v: wanted match, got %v, %v", filter, m, err)
+		}
+	}
+	if m, err := (Equals{"Address.Town", "Oslo"}).match(nil, value.Type(), value); err == nil {
+		t.Errorf("Wanted an error for a missing field, got %v", m)
+	}
+}
+
+type attributed struct {
+	Id    []byte
+	Name  string
+	Attrs map[string]string `unbolted:"index"`
+	Sizes map[string]int    `unbolted:"index"`
+}
+
+func TestMapFields(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	objs := []*attributed{
+		{Name: "a", Attrs: map[string]string{"env": "prod", "team": "x"}, Sizes: map[string]int{"disk": 10}},
+		{Name: "b", Attrs: map[string]string{"env": "dev"}},
+		{Name: "c", Attrs: map[string]string{"envy": "prod", "team": "y"}, Sizes: map[string]int{"disk": 5}},
+		{Name: "d"},
+	}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	objs[3].Attrs = map[string]string{"env": "prod"}
+	if err := d.Set(objs[3]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	objs[0].Attrs = map[string]string{"env": "prod"}
+	if err := d.Set(objs[0]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, c := range []struct {
+		filter QFilter
+		wanted []string
+	}{
+		{KeyEquals{"Attrs", "env", "prod"}, []string{"a", "d"}},
+		{KeyEquals{"Attrs", "env", "dev"}, []string{"b"}},
+		{KeyEquals{"Sizes", "disk", 5}, []string{"c"}},
+		{HasKey{"Attrs", "env"}, []string{"a", "b", "d"}},
+		{HasKey{"Attrs", "team"}, []string{"c"}},
+		{HasKey{"Sizes", "disk"}, []string{"a", "c"}},
+		{HasKey{"Attrs", "nope"}, nil},
+		{And{HasKey{"Attrs", "env"}, HasKey{"Sizes", "disk"}}, []string{"a"}},
+	} {
+		var res []attributed
+		if err := d.Query().Where(c.filter).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		var got []string
+		for _, r := range res {
+			got = append(got, r.Name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, got)
+		}
+		for _, obj := range objs {
+			value := reflect.ValueOf(obj).Elem()
+			m, err := c.filter.match(nil, value.Type(), value)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			wanted := false
+			for _, name := range c.wanted {
+				wanted = wanted || name == obj.Name
+			}
+			if m != wanted {
+				t.Errorf("%+v: wrong match %v for %+v", c.filter, m, obj)
+			}
+		}
+	}
+	var res []attributed
+	if err := d.Query().Where(HasKey{"Name", "x"}).All(&res); err == nil {
+		t.Fatalf("Wanted an error for HasKey on a non map field")
+	}
+}
+
+func TestNot(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	objs := []*orderStruct{{Name: "a", Rank: 1}, {Name: "a", Rank: 2}, {Name: "b", Rank: 1}, {Name: "b", Rank: 3}, {Name: "c", Rank: 4}}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		query  *Query
+		wanted []string
+	}{
+		{d.Query().Where(Not{Equals{"Name", "a"}}), []string{"b1", "b3", "c4"}},
+		{d.Query().Where(And{Equals{"Rank", 1}, Not{Or{Equals{"Name", "a"}, Equals{"Name", "c"}}}}), []string{"b1"}},
+		{d.Query().Where(And{Not{Equals{"Name", "a"}}, Not{Equals{"Rank", 4}}}), []string{"b1", "b3"}},
+		{d.Query().Where(Or{Not{Greater{"Rank", 1}}, Equals{"Name", "c"}}), []string{"a1", "b1", "c4"}},
+		{d.Query().Where(Not{Not{Equals{"Name", "b"}}}), []string{"b1", "b3"}},
+		{d.Query().Where(Not{Equals{"Name", "b"}}).Except(Equals{"Rank", 2}), []string{"a1", "c4"}},
+	} {
+		var res []orderStruct
+		if err := c.query.OrderBy("Name", Asc).OrderBy("Rank", Asc).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := orderNames(res); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("Wanted %v but got %v", c.wanted, got)
+		}
+		c.query.typ = reflect.TypeOf(orderStruct{})
+		for _, obj := range objs {
+			value := reflect.ValueOf(obj).Elem()
+			m, err := c.query.match(nil, value.Type(), value)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			wanted := false
+			for _, name := range c.wanted {
+				wanted = wanted || name == fmt.Sprintf("%v%v", obj.Name, obj.Rank)
+			}
+			if m != wanted {
+				t.Errorf("Wrong match %v for %+v", m, obj)
+			}
+		}
+	}
+}
+
+func permutations(n int) (result [][]int) {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	for _, p := range permutations(n - 1) {
+		for i := 0; i <= len(p); i++ {
+			result = append(result, append(append(append([]int{}, p[:i]...), n-1), p[i:]...))
+		}
+	}
+	return
+}
+
+func TestNestedNot(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	// The results of nested differences depend on the order of the Ids, so try them all.
+	for _, perm := range permutations(5) {
+		if err := d.Clear(); err != nil {
+			t.Fatalf(err.Error())
+		}
+		for index, obj := range []*orderStruct{{Name: "a", Rank: 1}, {Name: "a", Rank: 2}, {Name: "b", Rank: 1}, {Name: "b", Rank: 3}, {Name: "c", Rank: 4}} {
+			obj.Id = []byte{byte(perm[index])}
+			if err := d.Set(obj); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		for _, c := range []struct {
+			query  *Query
+			wanted []string
+		}{
+			{d.Query().Where(Not{Not{Equals{"Name", "b"}}}), []string{"b1", "b3"}},
+			{d.Query().Where(And{Not{Equals{"Name", "a"}}, Not{Not{Equals{"Rank", 1}}}}), []string{"b1"}},
+			{d.Query().Where(Or{Not{Not{Equals{"Name", "c"}}}, And{Equals{"Name", "a"}, Not{Equals{"Rank", 1}}}}), []string{"a2", "c4"}},
+			{d.Query().Where(Not{Not{Greater{"Rank", 1}}}), []string{"a2", "b3", "c4"}},
+			{d.Query().Where(And{Not{Less{"Rank", 2}}, Not{Not{Between{"Rank", 1, 3}}}}), []string{"a2", "b3"}},
+		} {
+			var res []orderStruct
+			if err := c.query.OrderBy("Name", Asc).OrderBy("Rank", Asc).All(&res); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if got := orderNames(res); !reflect.DeepEqual(got, c.wanted) {
+				t.Errorf("Ids %v: wanted %v but got %v", perm, c.wanted, got)
+			}
+		}
+	}
+}
+
+func TestSpanSkipper(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Ids 1 and 3 share a value bucket, so the span merges three cursors.
+	for _, obj := range []*orderStruct{{Id: []byte{1}, Rank: 2}, {Id: []byte{2}, Rank: 3}, {Id: []byte{3}, Rank: 2}, {Id: []byte{4}, Rank: 4}, {Id: []byte{5}, Rank: 1}} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := d.View(func(tx *TX) (err error) {
+		source, err := Greater{"Rank", 1}.source(tx, reflect.TypeOf(orderStruct{}))
+		if err != nil {
+			return
+		}
+		s, err := tx.skipper(source.Key)
+		if err != nil {
+			return
+		}
+		for _, step := range []struct {
+			min    []byte
+			inc    bool
+			wanted []byte
+		}{
+			{nil, true, []byte{1}},
+			{[]byte{1}, false, []byte{2}},
+			{[]byte{2}, true, []byte{2}},
+			{[]byte{1}, true, []byte{1}},
+			{[]byte{3}, false, []byte{4}},
+			{[]byte{3}, true, []byte{3}},
+			{[]byte{4}, false, nil},
+			{[]byte{0}, true, []byte{1}},
+		} {
+			var res *setop.SetOpResult
+			if res, err = s.Skip(step.min, step.inc); err != nil {
+				return
+			}
+			var got []byte
+			if res != nil {
+				got = res.Key
+			}
+			if !bytes.Equal(got, step.wanted) {
+				t.Errorf("Skip(%v, %v): wanted %v but got %v", step.min, step.inc, step.wanted, got)
+			}
+		}
+		return
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+type folded struct {
+	Id       Id
+	Name     string   `unbolted:"index,fold"`
+	Nick     *string  `unbolted:"index"`
+	Tags     []string `unbolted:"index,fold"`
+	Username string   `unbolted:"unique,fold"`
+}
+
+func foldedNames(objs []folded) (result []string) {
+	for _, obj := range objs {
+		result = append(result, obj.Name)
+	}
+	sort.Strings(result)
+	return
+}
+
+func TestPrefixFold(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	jo, Jo := "jo", "Jo"
+	objs := []*folded{
+		{Name: "Jöhn", Nick: &Jo, Tags: []string{"Café"}, Username: "john"},
+		{Name: "joanna", Nick: &jo, Username: "joanna"},
+		{Name: "JOSÉ", Tags: []string{"cafe", "BAR"}, Username: "jose"},
+		{Name: "Bob", Username: "bob"},
+	}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := d.Set(&folded{Name: "Other", Username: "BÖB"}); err == nil {
+		t.Errorf("Wanted unique violation for folded username")
+	}
+	for _, c := range []struct {
+		filter QFilter
+		wanted []string
+	}{
+		{Prefix{"Name", "jo"}, []string{"JOSÉ", "Jöhn", "joanna"}},
+		{Prefix{"Name", "JOH"}, []string{"Jöhn"}},
+		{Prefix{"Name", ""}, []string{"Bob", "JOSÉ", "Jöhn", "joanna"}},
+		{Prefix{"Name", "x"}, nil},
+		{Equals{"Name", "jose"}, []string{"JOSÉ"}},
+		{Equals{"Name", "John"}, []string{"Jöhn"}},
+		{Prefix{"Nick", "J"}, []string{"Jöhn"}},
+		{Prefix{"Nick", "j"}, []string{"joanna"}},
+		{Prefix{"Nick", ""}, []string{"Jöhn", "joanna"}},
+		{Contains{"Tags", "CAFÉ"}, []string{"JOSÉ", "Jöhn"}},
+		{Prefix{"Tags", "ba"}, []string{"JOSÉ"}},
+		{And{Prefix{"Name", "j"}, Not{Prefix{"Name", "joa"}}}, []string{"JOSÉ", "Jöhn"}},
+	} {
+		var res []folded
+		if err := d.Query().Where(c.filter).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := foldedNames(res); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, got)
+		}
+		for _, obj := range objs {
+			value := reflect.ValueOf(obj).Elem()
+			m, err := c.filter.match(nil, value.Type(), value)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			wanted := false
+			for _, name := range c.wanted {
+				wanted = wanted || name == obj.Name
+			}
+			if m != wanted {
+				t.Errorf("%+v: wrong match %v for %+v", c.filter, m, obj)
+			}
+		}
+	}
+	var res []folded
+	if err := d.Query().OrderBy("Name", Asc).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var names []string
+	for _, obj := range res {
+		names = append(names, obj.Name)
+	}
+	if wanted := []string{"Bob", "joanna", "Jöhn", "JOSÉ"}; !reflect.DeepEqual(names, wanted) {
+		t.Errorf("Wanted %v but got %v", wanted, names)
+	}
+	if err := d.Query().Where(Prefix{"Id", "a"}).All(&res); err == nil {
+		t.Errorf("Wanted error for prefix of non string field")
+	}
+}
+
+type article struct {
+	Id    Id
+	Title string  `unbolted:"index"`
+	Body  string  `unbolted:"fulltext"`
+	Notes *string `unbolted:"fulltext"`
+}
+
+func articleTitles(objs []article) (result []string) {
+	for _, obj := range objs {
+		result = append(result, obj.Title)
+	}
+	return
+}
+
+func TestFulltext(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if got := tokenize("The quick brown Fox jumped over the lazy dogs, running quickly!"); !reflect.DeepEqual(got, []string{"the", "quick", "brown", "fox", "jump", "over", "the", "lazy", "dog", "run", "quick"}) {
+		t.Errorf("Wrong tokens %v", got)
+	}
+	notes := "Ponies and FOXES"
+	a := &article{Title: "a", Body: "A fox jumps over a fox, and another fox is jumping.", Notes: &notes}
+	b := &article{Title: "b", Body: "The quick brown fox jumped over the lazy dog."}
+	c := &article{Title: "c", Body: "Dogs are running in the café."}
+	for _, obj := range []*article{a, b, c} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, tc := range []struct {
+		filter QFilter
+		wanted []string
+	}{
+		{Match{"Body", "fox"}, []string{"a", "b"}},
+		{Match{"Body", "Jumping FOXES"}, []string{"a", "b"}},
+		{Match{"Body", "dog"}, []string{"b", "c"}},
+		{Match{"Body", "cafe run"}, []string{"c"}},
+		{Match{"Body", "fox cafe"}, nil},
+		{Match{"Body", "  "}, nil},
+		{Match{"Notes", "pony"}, []string{"a"}},
+		{And{Match{"Body", "dog"}, Not{Match{"Body", "lazy"}}}, []string{"c"}},
+	} {
+		var res []article
+		if err := d.Query().Where(tc.filter).OrderBy("Title", Asc).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := articleTitles(res); !reflect.DeepEqual(got, tc.wanted) {
+			t.Errorf("%+v: wanted %v but got %v", tc.filter, tc.wanted, got)
+		}
+		for _, obj := range []*article{a, b, c} {
+			value := reflect.ValueOf(obj).Elem()
+			m, err := tc.filter.match(nil, value.Type(), value)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			wanted := false
+			for _, title := range tc.wanted {
+				wanted = wanted || title == obj.Title
+			}
+			if m != wanted {
+				t.Errorf("%+v: wrong match %v for %+v", tc.filter, m, obj)
+			}
+		}
+	}
+	var res []article
+	if err := d.Query().Where(Or{Match{"Body", "fox"}, Match{"Body", "dog"}}).Rank().All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if got := articleTitles(res); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Wrong ranking %v", got)
+	}
+	c.Body = "Dogs, dogs, dogs and a fox."
+	if err := d.Set(c); err != nil {
+		t.Fatalf(err.Error())
+	}
+	res = nil
+	if err := d.Query().Where(Match{"Body", "dog"}).Rank().Limit(1).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if got := articleTitles(res); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("Wrong ranking %v", got)
+	}
+	res = nil
+	if err := d.Query().Where(Match{"Body", "cafe"}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	} else if len(res) != 0 {
+		t.Errorf("Wanted no results for de-indexed term, got %v", articleTitles(res))
+	}
+	if err := d.Del(a); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count, err := d.Query().Where(Match{"Notes", "pony"}).Count(&article{}); err != nil {
+		t.Fatalf(err.Error())
+	} else if count != 0 {
+		t.Errorf("Wanted no results for deleted object, got %v", count)
+	}
+	if err := d.Query().Where(Match{"Title", "a"}).All(&res); err == nil {
+		t.Errorf("Wanted error for match on field not annotated with fulltext")
+	}
+}
+
+type scanned struct {
+	Id       Id
+	Name     string `unbolted:"index"`
+	Rank     int
+	Nick     string `unbolted:"index:nick_rank"`
+	NickRank int    `unbolted:"index:nick_rank"`
+}
+
+func scannedNames(objs []scanned) (result []string) {
+	for _, obj := range objs {
+		result = append(result, obj.Name)
+	}
+	return
+}
+
+func TestScan(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, obj := range []*scanned{
+		{Name: "a", Rank: 1, Nick: "x", NickRank: 1},
+		{Name: "b", Rank: 2, Nick: "x", NickRank: 2},
+		{Name: "c", Rank: 3, Nick: "y", NickRank: 1},
+		{Name: "d", Rank: 2, Nick: "y", NickRank: 2},
+	} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		filter     QFilter
+		difference QFilter
+		wanted     []string
+		scan       bool
+	}{
+		{Equals{"Rank", 2}, nil, []string{"b", "d"}, true},
+		{Greater{"Rank", 1}, nil, []string{"b", "c", "d"}, true},
+		{And{Equals{"Rank", 2}, Equals{"Name", "b"}}, nil, []string{"b"}, true},
+		{Or{Equals{"Rank", 3}, Equals{"Name", "a"}}, nil, []string{"a", "c"}, true},
+		{And{Or{Equals{"Rank", 3}, Equals{"Name", "a"}}, Not{Equals{"Name", "c"}}}, nil, []string{"a"}, true},
+		{Not{Equals{"Rank", 2}}, nil, []string{"a", "c"}, true},
+		{And{Equals{"Name", "b"}, Not{Equals{"Rank", 2}}}, nil, nil, true},
+		{Equals{"Name", "a"}, nil, []string{"a"}, false},
+		{nil, Equals{"Rank", 2}, []string{"a", "c"}, true},
+		{Greater{"Name", "a"}, And{Equals{"Name", "b"}, Equals{"Rank", 3}}, []string{"b", "c", "d"}, true},
+		{Equals{"Nick", "x"}, nil, []string{"a", "b"}, false},
+		{And{Equals{"Nick", "y"}, Equals{"NickRank", 2}}, nil, []string{"d"}, false},
+		{Equals{"NickRank", 2}, nil, []string{"b", "d"}, true},
+	} {
+		query := func() *Query {
+			q := d.Query().OrderBy("Name", Asc)
+			if c.filter != nil {
+				q.Where(c.filter)
+			}
+			if c.difference != nil {
+				q.Except(c.difference)
+			}
+			return q
+		}
+		var res []scanned
+		if err := query().All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := scannedNames(res); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%+v except %+v: wanted %v but got %v", c.filter, c.difference, c.wanted, got)
+		}
+		if count, err := query().Count(&scanned{}); err != nil {
+			t.Fatalf(err.Error())
+		} else if count != len(c.wanted) {
+			t.Errorf("%+v except %+v: wanted %v results but counted %v", c.filter, c.difference, len(c.wanted), count)
+		}
+		res = nil
+		err := query().Strict().All(&res)
+		if _, ok := err.(ErrNotIndexed); ok != c.scan {
+			t.Errorf("%+v except %+v: wanted ErrNotIndexed %v but got %v", c.filter, c.difference, c.scan, err)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, obj := range []*scanned{
+		{Name: "a", Rank: 1},
+		{Name: "a", Rank: 2},
+		{Name: "b", Rank: 2},
+		{Name: "c", Rank: 3},
+	} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	explanation, err := d.Query().Where(And{Equals{"Name", "a"}, Equals{"Rank", 2}}).Except(Equals{"Name", "c"}).Explain(&scanned{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	wanted := &Plan{
+		Operation: "difference",
+		Sources: []*Plan{
+			&Plan{
+				Operation: "intersection",
+				Sources: []*Plan{
+					&Plan{Operation: "source", Key: "pk/scanned"},
+					&Plan{
+						Operation: "intersection",
+						Sources: []*Plan{
+							&Plan{Operation: "source", Key: `2i/scanned/Name/"a"`},
+						},
+					},
+				},
+			},
+			&Plan{Operation: "source", Key: `2i/scanned/Name/"c"`},
+		},
+	}
+	if !reflect.DeepEqual(explanation.Plan, wanted) {
+		t.Errorf("Wanted\n%v\nbut got\n%v", wanted, explanation.Plan)
+	}
+	if explanation.Residual == "" {
+		t.Errorf("Wanted a residual filter for the non indexed field")
+	}
+	profile, err := d.Query().Where(Equals{"Name", "a"}).Profile(&scanned{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if profile.Results != 2 {
+		t.Errorf("Wanted 2 results, got %v", profile.Results)
+	}
+	if profile.Duration <= 0 {
+		t.Errorf("Wanted a duration, got %v", profile.Duration)
+	}
+	if index := profile.Plan.Sources[1]; index.Key != `2i/scanned/Name/"a"` || index.Examined != 2 || index.Duration <= 0 || index.Duration > profile.Duration {
+		t.Errorf("Wanted 2 examined keys in the Name index, and the time spent reading them, got %+v", index)
+	}
+	if s := profile.String(); !strings.Contains(s, `source 2i/scanned/Name/"a" (2 examined in `) {
+		t.Errorf("Wrong description %v", s)
+	}
+	if profile, err = d.Query().OrderBy("Name", Asc).Profile(&scanned{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(profile.Walked) != 1 || profile.Walked[0].Key != "2i/scanned/Name" || profile.Walked[0].Examined == 0 {
+		t.Errorf("Wanted the Name index to be walked, got %v", profile)
+	}
+	if s := profile.String(); !strings.Contains(s, "ordered by Name asc") || !strings.Contains(s, "4 results in") {
+		t.Errorf("Wrong description %v", s)
+	}
+	if profile, err = d.Query().Where(Equals{"Name", "a"}).OrderBy("Name", Asc).Profile(&scanned{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if profile.Results != 2 {
+		t.Errorf("Wanted 2 results, got %v", profile)
+	}
+	if len(profile.Walked) != 1 || profile.Walked[0].Key != "2i/scanned/Name" || profile.Walked[0].Examined != 3 {
+		t.Errorf("Wanted the 3 values of the Name index to be walked, got %v", profile)
+	}
+	if s := profile.String(); !strings.Contains(s, "walk 2i/scanned/Name (3 examined)") || !strings.Contains(s, "2 results in") {
+		t.Errorf("Wrong description %v", s)
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	objs := []*orderStruct{{Name: "x", Rank: 1}}
+	for i := 0; i < 5; i++ {
+		objs = append(objs, &orderStruct{Name: fmt.Sprint(i), Rank: 1})
+	}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	rankKey := joinKeys([][]byte{secondaryIndex, []byte("orderStruct"), []byte("Rank"), mustValueBytes(t, orderStruct{}, "Rank", 1)})
+	nameKey := joinKeys([][]byte{secondaryIndex, []byte("orderStruct"), []byte("Name"), []byte("x")})
+	assertCardinality := func(key []byte, wanted int) {
+		if err := d.View(func(tx *TX) error {
+			if got := tx.cardinality(setop.SetOpSource{Key: key}); got != wanted {
+				t.Errorf("Wanted cardinality %v for %v, got %v", wanted, describeKey(key), got)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	assertCardinality(rankKey, 6)
+	assertCardinality(nameKey, 1)
+	explanation, err := d.Query().Where(And{Equals{"Rank", 1}, Equals{"Name", "x"}}).Explain(&orderStruct{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if sources := explanation.Plan.Sources[1].Sources; len(sources) != 2 || sources[0].Key != `2i/orderStruct/Name/"x"` {
+		t.Errorf("Wanted the smallest source first, got\n%v", explanation)
+	}
+	if explanation, err = d.Query().Where(And{Equals{"Rank", 1}, Equals{"Name", "y"}}).Explain(&orderStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if plan := explanation.Plan.Sources[1]; plan.Operation != "empty" {
+		t.Errorf("Wanted an empty intersection, got\n%v", explanation)
+	}
+	if explanation, err = d.Query().Where(Or{Equals{"Name", "y"}, Equals{"Name", "x"}}).Explain(&orderStruct{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if plan := explanation.Plan.Sources[1]; len(plan.Sources) != 1 {
+		t.Errorf("Wanted empty sources to be removed from union, got\n%v", explanation)
+	}
+	objs[0].Rank = 2
+	if err := d.Set(objs[0]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Del(objs[1]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertCardinality(rankKey, 4)
+	assertCardinality(nameKey, 1)
+	var res []orderStruct
+	if err := d.Query().Where(And{Equals{"Rank", 1}, Equals{"Name", "x"}}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	} else if len(res) != 0 {
+		t.Errorf("Wanted no results, got %v", res)
+	}
+	if err := d.Query().Where(And{Equals{"Rank", 2}, Equals{"Name", "x"}}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	} else if len(res) != 1 {
+		t.Errorf("Wanted one result, got %v", res)
+	}
+	if err := d.Del(objs[0]); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertCardinality(nameKey, 0)
+	// Buckets without counts are not counted when read, or when changed.
+	if err := d.Update(func(tx *TX) error {
+		return tx.tx.Bucket(cardinalityKey).Delete(rankKey)
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertCardinality(rankKey, unknownCardinality)
+	if err := d.Set(&orderStruct{Name: "z", Rank: 1}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertCardinality(rankKey, unknownCardinality)
+	for i := 0; i <= spanProbe; i++ {
+		if err := d.Set(&orderStruct{Name: "span", Rank: 100 + i}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	assertSpanCardinality := func(filter QFilter, wanted int) {
+		if err := d.View(func(tx *TX) error {
+			source, _, err := planFilter(tx, reflect.TypeOf(orderStruct{}), filter)
+			if err != nil {
+				return err
+			}
+			if got := tx.cardinality(*source); got != wanted {
+				t.Errorf("Wanted cardinality %v for %+v, got %v", wanted, filter, got)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	assertSpanCardinality(Between{"Rank", 100, 101}, 2)
+	assertSpanCardinality(Greater{"Rank", 50}, unknownCardinality)
+}
+
+func mustValueBytes(t *testing.T, obj interface{}, field string, value interface{}) []byte {
+	b, err := valueBytes(reflect.TypeOf(obj), field, value)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return b
+}
+
+type issue struct {
+	Id       Id
+	Status   string            `unbolted:"index"`
+	Owner    string            `unbolted:"index"`
+	Priority int               `unbolted:"index"`
+	Archived bool              `unbolted:"index"`
+	Score    *float64          `unbolted:"index"`
+	Tags     []string          `unbolted:"index"`
+	Attrs    map[string]string `unbolted:"index"`
+	Due      time.Time         `unbolted:"index"`
+}
+
+func TestParse(t *testing.T) {
+	score := 1.5
+	due := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, c := range []struct {
+		query  string
+		where  QFilter
+		except QFilter
+	}{
+		{`Status = "open"`, Equals{"Status", "open"}, nil},
+		{
+			`Status = "open" AND (Owner = "x" OR Priority > 3) EXCEPT Archived = true`,
+			And{Equals{"Status", "open"}, Or{Equals{"Owner", "x"}, Greater{"Priority", 3}}},
+			Equals{"Archived", true},
+		},
+		{
+			`Status = "a" or Status != "b" and not Priority <= -2`,
+			Or{Equals{"Status", "a"}, And{Not{Equals{"Status", "b"}}, Not{LessOrEqual{"Priority", -2}}}},
+			nil,
+		},
+		{`Score = null OR Score >= 1.5`, Or{Equals{"Score", nil}, GreaterOrEqual{"Score", score}}, nil},
+		{`Tags CONTAINS "x" AND Attrs HAS "env" AND Attrs["env"] = "prod"`, And{Contains{"Tags", "x"}, HasKey{"Attrs", "env"}, KeyEquals{"Attrs", "env", "prod"}}, nil},
+		{`Owner PREFIX "jo" AND Due < "2020-01-02T03:04:05Z"`, And{Prefix{"Owner", "jo"}, Less{"Due", due}}, nil},
+	} {
+		where, except, err := Parse(&issue{}, c.query)
+		if err != nil {
+			t.Errorf("%v: %v", c.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(where, c.where) || !reflect.DeepEqual(except, c.except) {
+			t.Errorf("%v: wanted %#v except %#v but got %#v except %#v", c.query, c.where, c.except, where, except)
+		}
+	}
+	for _, query := range []string{
+		`Missing = 1`,
+		`Status = 1`,
+		`Priority = "1"`,
+		`Priority = 1.5`,
+		`Archived = maybe`,
+		`Status = "open" AND`,
+		`(Status = "open"`,
+		`Status = "open")`,
+		`Status ~ "open"`,
+		`Status CONTAINS "x"`,
+		`Status HAS "x"`,
+		`Priority = null`,
+		`Status = "open`,
+		`Due > "yesterday"`,
+	} {
+		if _, _, err := Parse(&issue{}, query); err == nil {
+			t.Errorf("%v: wanted an error", query)
+		}
+	}
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, obj := range []*issue{
+		{Status: "open", Owner: "x", Priority: 1},
+		{Status: "open", Owner: "y", Priority: 4},
+		{Status: "open", Owner: "y", Priority: 1},
+		{Status: "open", Owner: "x", Priority: 5, Archived: true},
+		{Status: "closed", Owner: "x", Priority: 5},
+	} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	query, err := d.Query().Parse(&issue{}, `Status = "open" AND (Owner = "x" OR Priority > 3) EXCEPT Archived = true`)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var res []issue
+	if err := query.OrderBy("Priority", Asc).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != 2 || res[0].Owner != "x" || res[1].Owner != "y" {
+		t.Errorf("Wrong results %+v", res)
+	}
+}
+
+type nearRank struct {
+	center int
+	radius int
+}
+
+func (self nearRank) Source(tx *TX, typ reflect.Type) (result setop.SetOpSource, exact bool, err error) {
+	result, err = tx.Source(typ, Between{"Rank", self.center - self.radius, self.center + self.radius})
+	return
+}
+
+func (self nearRank) Match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	rank := int(value.FieldByName("Rank").Int())
+	result = rank >= self.center-self.radius && rank <= self.center+self.radius && rank%2 == 0
+	return
+}
+
+type longName int
+
+func (self longName) Match(tx *TX, typ reflect.Type, value reflect.Value) (result bool, err error) {
+	return len(value.FieldByName("Name").String()) >= int(self), nil
+}
+
+func TestCustomFilter(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	objs := []*orderStruct{{Name: "a", Rank: 1}, {Name: "bb", Rank: 2}, {Name: "ccc", Rank: 3}, {Name: "dddd", Rank: 4}, {Name: "eeeee", Rank: 6}}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, c := range []struct {
+		filter QFilter
+		wanted []string
+	}{
+		{Custom(nearRank{3, 2}), []string{"bb2", "dddd4"}},
+		{Custom(longName(3)), []string{"ccc3", "dddd4", "eeeee6"}},
+		{And{Custom(nearRank{3, 2}), Not{Custom(longName(3))}}, []string{"bb2"}},
+		{Or{Custom(nearRank{5, 1}), Equals{"Name", "a"}}, []string{"a1", "dddd4", "eeeee6"}},
+		{And{Custom(longName(4)), Less{"Rank", 5}}, []string{"dddd4"}},
+	} {
+		var res []orderStruct
+		if err := d.Query().Where(c.filter).OrderBy("Rank", Asc).All(&res); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := orderNames(res); !reflect.DeepEqual(got, c.wanted) {
+			t.Errorf("%+v: wanted %v but got %v", c.filter, c.wanted, got)
+		}
+		q := d.Query().Where(c.filter)
+		q.typ = reflect.TypeOf(orderStruct{})
+		for _, obj := range objs {
+			value := reflect.ValueOf(obj).Elem()
+			m, err := q.match(nil, value.Type(), value)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			wanted := false
+			for _, name := range c.wanted {
+				wanted = wanted || name == fmt.Sprintf("%v%v", obj.Name, obj.Rank)
+			}
+			if m != wanted {
+				t.Errorf("%+v: wrong match %v for %+v", c.filter, m, obj)
+			}
+		}
+	}
+	if err := d.Query().Where(Custom(longName(3))).Strict().All(&[]orderStruct{}); err == nil {
+		t.Errorf("Wanted strict query with scan only filter to fail")
+	}
+}
+
+type sale struct {
+	Id     Id
+	Region string `unbolted:"index"`
+	Amount float64
+	Units  *int
+	Rank   int `unbolted:"index"`
+}
+
+func TestAggregates(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	one, three := 1, 3
+	for _, obj := range []*sale{
+		{Region: "north", Amount: 10, Units: &one, Rank: 3},
+		{Region: "south", Amount: 2.5, Rank: -1},
+		{Region: "north", Amount: 7.5, Units: &three, Rank: 7},
+		{Region: "east", Amount: 4, Rank: 2},
+	} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if sum, err := d.Query().Sum(&sale{}, "Amount"); err != nil {
+		t.Fatalf(err.Error())
+	} else if sum != 24 {
+		t.Errorf("Wanted 24, got %v", sum)
+	}
+	if sum, err := d.Query().Where(Equals{"Region", "north"}).Sum(&sale{}, "Units"); err != nil {
+		t.Fatalf(err.Error())
+	} else if sum != 4 {
+		t.Errorf("Wanted 4, got %v", sum)
+	}
+	if avg, found, err := d.Query().Avg(&sale{}, "Units"); err != nil {
+		t.Fatalf(err.Error())
+	} else if !found || avg != 2 {
+		t.Errorf("Wanted 2, got %v %v", avg, found)
+	}
+	if _, found, err := d.Query().Where(Equals{"Region", "west"}).Avg(&sale{}, "Amount"); err != nil {
+		t.Fatalf(err.Error())
+	} else if found {
+		t.Errorf("Wanted no average")
+	}
+	for _, c := range []struct {
+		query  *Query
+		field  string
+		min    interface{}
+		max    interface{}
+		exists bool
+	}{
+		{d.Query(), "Rank", -1, 7, true},
+		{d.Query().Where(Equals{"Region", "north"}), "Rank", 3, 7, true},
+		{d.Query(), "Amount", 2.5, 10.0, true},
+		{d.Query(), "Region", "east", "south", true},
+		{d.Query(), "Units", 1, 3, true},
+		{d.Query().Where(Equals{"Region", "south"}), "Units", nil, nil, false},
+		{d.Query().Where(Equals{"Region", "west"}), "Rank", nil, nil, false},
+	} {
+		min, found, err := c.query.Min(&sale{}, c.field)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if found != c.exists || (found && !reflect.DeepEqual(reflect.Indirect(reflect.ValueOf(min)).Interface(), c.min)) {
+			t.Errorf("Wanted min %v of %v, got %v %v", c.min, c.field, min, found)
+		}
+		max, found, err := c.query.Max(&sale{}, c.field)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if found != c.exists || (found && !reflect.DeepEqual(reflect.Indirect(reflect.ValueOf(max)).Interface(), c.max)) {
+			t.Errorf("Wanted max %v of %v, got %v %v", c.max, c.field, max, found)
+		}
+	}
+	groups, err := d.Query().Except(Equals{"Region", "east"}).GroupBy(&sale{}, "Region", "Amount", "Units")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	wanted := []Group{
+		{Value: "north", Count: 2, Sums: map[string]float64{"Amount": 17.5, "Units": 4}},
+		{Value: "south", Count: 1, Sums: map[string]float64{"Amount": 2.5, "Units": 0}},
+	}
+	if !reflect.DeepEqual(groups, wanted) {
+		t.Errorf("Wanted %+v, got %+v", wanted, groups)
+	}
+	if sum, err := d.Query().OrderBy("Rank", Desc).Limit(2).Sum(&sale{}, "Amount"); err != nil {
+		t.Fatalf(err.Error())
+	} else if sum != 17.5 {
+		t.Errorf("Wanted 17.5 for the two highest ranks, got %v", sum)
+	}
+	groups, err = d.Query().OrderBy("Rank", Asc).Limit(2).GroupBy(&sale{}, "Region", "Amount")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	wanted = []Group{
+		{Value: "east", Count: 1, Sums: map[string]float64{"Amount": 4}},
+		{Value: "south", Count: 1, Sums: map[string]float64{"Amount": 2.5}},
+	}
+	if !reflect.DeepEqual(groups, wanted) {
+		t.Errorf("Wanted %+v for the two lowest ranks, got %+v", wanted, groups)
+	}
+	for _, obj := range []*folded{{Name: "Zed", Username: "z"}, {Name: "alice", Username: "a"}} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, query := range []*Query{d.Query(), d.Query().Limit(5)} {
+		if min, _, err := query.Min(&folded{}, "Name"); err != nil {
+			t.Fatalf(err.Error())
+		} else if min != "alice" {
+			t.Errorf("Wanted alice as the folded minimum, got %v", min)
+		}
+		if max, _, err := query.Max(&folded{}, "Name"); err != nil {
+			t.Fatalf(err.Error())
+		} else if max != "Zed" {
+			t.Errorf("Wanted Zed as the folded maximum, got %v", max)
+		}
+	}
+	if _, err := d.Query().Sum(&sale{}, "Region"); err == nil {
+		t.Errorf("Wanted error summing strings")
+	}
+	if _, err := d.Query().Sum(&sale{}, "Missing"); err == nil {
+		t.Errorf("Wanted error summing missing field")
+	}
+}
+
+func TestFacets(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, obj := range []*tagged{
+		{Name: "a", Tags: []string{"x", "y"}, Nums: []int{3}},
+		{Name: "b", Tags: []string{"y"}, Nums: []int{-1, 3}},
+		{Name: "c", Tags: []string{"y", "z"}},
+	} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for _, obj := range []*orderStruct{{Name: "a", Rank: 2}, {Name: "b", Rank: 1}, {Name: "c", Rank: 2}} {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := d.View(func(tx *TX) (err error) {
+		for _, c := range []struct {
+			obj    interface{}
+			field  string
+			query  *Query
+			wanted []Facet
+		}{
+			{&tagged{}, "Tags", nil, []Facet{{"x", 1}, {"y", 3}, {"z", 1}}},
+			{&tagged{}, "Nums", nil, []Facet{{-1, 1}, {3, 2}}},
+			{&tagged{}, "Tags", tx.Query().Where(Contains{"Nums", 3}), []Facet{{"x", 1}, {"y", 2}}},
+			{&tagged{}, "Tags", tx.Query().Where(Equals{"Name", "c"}), []Facet{{"y", 1}, {"z", 1}}},
+			{&orderStruct{}, "Rank", nil, []Facet{{1, 1}, {2, 2}}},
+			{&orderStruct{}, "Rank", tx.Query().Except(Equals{"Name", "a"}), []Facet{{1, 1}, {2, 1}}},
+			{&orderStruct{}, "Rank", tx.Query().OrderBy("Name", Desc).Limit(2), []Facet{{1, 1}, {2, 1}}},
+			{&orderStruct{}, "Rank", tx.Query().Where(Equals{"Name", "d"}), nil},
+		} {
+			var facets []Facet
+			if facets, err = tx.Facets(c.obj, c.field, c.query); err != nil {
+				return
+			}
+			if !reflect.DeepEqual(facets, c.wanted) {
+				t.Errorf("%v: wanted %v but got %v", c.field, c.wanted, facets)
+			}
+		}
+		var values []interface{}
+		if values, err = tx.Distinct(&orderStruct{}, "Name"); err != nil {
+			return
+		}
+		if !reflect.DeepEqual(values, []interface{}{"a", "b", "c"}) {
+			t.Errorf("Wrong distinct values %v", values)
+		}
+		if _, err := tx.Distinct(&tagged{}, "Name"); err == nil {
+			t.Errorf("Wanted error for distinct values of non indexed field")
+		}
+		return
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestSelect(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	people := []*person{
+		{Name: "a", Address: Address{City: "Oslo", Zip: 1}, Home: &geo{Lat: 59.9}, Work: Address{City: "Bergen"}},
+		{Name: "b", Address: Address{City: "Stockholm", Zip: 2}, Home: &geo{Lat: -10}, Work: Address{City: "Oslo"}},
+	}
+	for _, p := range people {
+		if err := d.Set(p); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	var res []person
+	if err := d.Query().Select("Name", "City").OrderBy("Zip", Asc).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	wanted := []person{
+		{Id: people[0].Id, Name: "a", Address: Address{City: "Oslo"}},
+		{Id: people[1].Id, Name: "b", Address: Address{City: "Stockholm"}},
+	}
+	if !reflect.DeepEqual(res, wanted) {
+		t.Errorf("Wanted %+v but got %+v", wanted, res)
+	}
+	res = nil
+	if err := d.Query().Select("Work.City").Where(Equals{"Name", "b"}).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != 1 || res[0].Name != "" || res[0].Work.City != "Oslo" || res[0].Home != nil {
+		t.Errorf("Wanted only the work address of b, got %+v", res)
+	}
+	res = nil
+	next, err := d.Query().Select("Name").OrderBy("Home.Lat", Asc).Limit(1).Page(&res)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	res = nil
+	if _, err := d.Query().Select("Name").OrderBy("Home.Lat", Asc).Limit(1).After(next).Page(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(res) != 1 || res[0].Name != "a" {
+		t.Errorf("Wanted a on the second page, got %+v", res)
+	}
+	maps, err := d.Query().Select("Name", "Address.Zip").Where(Equals{"City", "Stockholm"}).Maps(&person{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if wanted := []map[string]interface{}{{"Id": Id(people[1].Id), "Name": "b", "Address.Zip": 2}}; !reflect.DeepEqual(maps, wanted) {
+		t.Errorf("Wanted %v but got %v", wanted, maps)
+	}
+	if _, err := d.Query().Select("Town").Maps(&person{}); err == nil {
+		t.Errorf("Wanted an error selecting a missing field")
+	}
+	objs := []*orderStruct{{Name: "a", Rank: -2}, {Name: "b", Rank: 1}}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// Change the stored Rank behind the index, to tell values loaded from the index from decoded ones.
+	changed, err := json.Marshal(orderStruct{Id: objs[0].Id, Name: "a", Rank: 7})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := d.Update(func(tx *TX) error {
+		return tx.tx.Bucket(primaryKey).Bucket([]byte("orderStruct")).Put(objs[0].Id, changed)
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var ranks []orderStruct
+	if err := d.Query().Select("Rank").OrderBy("Rank", Asc).All(&ranks); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if wanted := []orderStruct{{Id: objs[0].Id, Rank: -2}, {Id: objs[1].Id, Rank: 1}}; !reflect.DeepEqual(ranks, wanted) {
+		t.Errorf("Wanted the ranks from the index %+v but got %+v", wanted, ranks)
+	}
+	ranks = nil
+	if err := d.Query().Select("Rank", "Name").OrderBy("Rank", Asc).All(&ranks); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if wanted := []orderStruct{{Id: objs[0].Id, Name: "a", Rank: 7}, {Id: objs[1].Id, Name: "b", Rank: 1}}; !reflect.DeepEqual(ranks, wanted) {
+		t.Errorf("Wanted the stored ranks %+v but got %+v", wanted, ranks)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	objs := []*orderStruct{{Name: "a", Rank: 2}, {Name: "b", Rank: 1}, {Name: "c", Rank: 3}}
+	for _, obj := range objs {
+		if err := d.Set(obj); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	var raws []Raw
+	if err := d.View(func(tx *TX) (err error) {
+		var b json.RawMessage
+		if b, err = tx.GetRaw(&orderStruct{Id: objs[1].Id}); err != nil {
+			return
+		}
+		loaded := &orderStruct{}
+		if err = json.Unmarshal(b, loaded); err != nil {
+			return
+		}
+		if !reflect.DeepEqual(loaded, objs[1]) {
+			t.Errorf("Wanted %+v but got %+v", objs[1], loaded)
+		}
+		if _, err := tx.GetRaw(&orderStruct{Id: []byte("missing")}); err != ErrNotFound {
+			t.Errorf("Wanted ErrNotFound, got %v", err)
+		}
+		raws, err = tx.Query().Where(Greater{"Rank", 1}).OrderBy("Rank", Desc).AllRaw(&orderStruct{})
+		return
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(raws) != 2 {
+		t.Fatalf("Wanted 2 results, got %v", raws)
+	}
+	for index, wanted := range []*orderStruct{objs[2], objs[0]} {
+		loaded := &orderStruct{}
+		if err := json.Unmarshal(raws[index].Value, loaded); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !reflect.DeepEqual(loaded, wanted) || !raws[index].Id.Equals(Id(wanted.Id)) {
+			t.Errorf("Wanted %+v but got %+v, %v", wanted, loaded, raws[index].Id)
+		}
+	}
+	count := 0
+	if err := d.Query().Limit(2).EachRaw(&orderStruct{}, func(raw Raw) (bool, error) {
+		count++
+		return true, nil
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count != 2 {
+		t.Errorf("Wanted 2 limited results, got %v", count)
+	}
+}
+
+type session struct {
+	Id   []byte
+	User string `unbolted:"index"`
+	Age  int    `unbolted:"index"`
+}
+
+var sessionChains []string
+
+func (self *session) Updated(d *DB, old *session) {
+	sessionChains = append(sessionChains, fmt.Sprintf("updated %v %v->%v", self.User, old.Age, self.Age))
+}
+
+func (self *session) Deleted(d *DB) {
+	sessionChains = append(sessionChains, fmt.Sprintf("deleted %v", self.User))
+}
+
+func TestBulk(t *testing.T) {
+	d, err := NewDB("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer d.Close()
+	if err := d.Clear(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for index, user := range []string{"a", "b", "c", "d"} {
+		if err := d.Set(&session{User: user, Age: index}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	events := make(chan Operation, 16)
+	sub, err := d.Query().Where(Greater{"Age", 0}).Subscription("bulk", &session{}, AllOps, func(obj interface{}, op Operation) error {
+		events <- op
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sub.Subscribe()
+	defer d.Unsubscribe("bulk")
+	sessionChains = nil
+	updated, err := d.Query().Where(Less{"Age", 2}).OrderBy("Age", Asc).Update(&session{}, func(obj interface{}) error {
+		obj.(*session).Age += 10
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if updated != 2 {
+		t.Errorf("Wanted 2 updated, got %v", updated)
+	}
+	deleted, err := d.Query().Where(Less{"Age", 10}).OrderBy("Age", Desc).Limit(1).Delete(&session{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if deleted != 1 {
+		t.Errorf("Wanted 1 deleted, got %v", deleted)
+	}
+	if wanted := []string{"updated a 0->10", "updated b 1->11", "deleted d"}; !reflect.DeepEqual(sessionChains, wanted) {
+		t.Errorf("Wanted chain calls %v but got %v", wanted, sessionChains)
+	}
+	var res []session
+	if err := d.Query().OrderBy("Age", Asc).All(&res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var got []string
+	for _, s := range res {
+		got = append(got, fmt.Sprintf("%v%v", s.User, s.Age))
+	}
+	if wanted := []string{"c2", "a10", "b11"}; !reflect.DeepEqual(got, wanted) {
+		t.Errorf("Wanted %v but got %v", wanted, got)
+	}
+	counts := map[Operation]int{}
+	for index := 0; index < 3; index++ {
+		select {
+		case op := <-events:
+			counts[op]++
+		case <-time.After(time.Second):
+			t.Fatalf("Wanted 3 events, got %v", counts)
+		}
+	}
+	if counts[Update] != 1 || counts[Create] != 1 || counts[Delete] != 1 {
+		t.Errorf("Wanted one of each event, got %v", counts)
+	}
+	if _, err := d.Query().Update(&session{}, func(obj interface{}) error {
+		obj.(*session).Id = []byte("other")
+		return nil
+	}); err == nil {
+		t.Errorf("Wanted an error when changing the Id")
+	}
+}